@@ -0,0 +1,112 @@
+package main
+
+import (
+	"google.golang.org/protobuf/proto"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// unresolvedAliases counts DATA metrics without a name whose alias was not
+// announced in the last BIRTH of their node or device. Served by /api/v1/stats.
+var unresolvedAliases atomic.Int64
+
+// aliasMaps holds the alias to metric name mapping of every node and device,
+// keyed by deviceKey.
+var aliasMaps = map[string]map[uint64]string{}
+var aliasMapsMutex sync.RWMutex
+
+// metricDataTypes holds the datatype of every metric announced in the last BIRTH
+// of every node and device, keyed by deviceKey and metric name. Guarded by aliasMapsMutex.
+var metricDataTypes = map[string]map[string]uint32{}
+
+func deviceKey(groupId string, edgeNodeId string, deviceId string) string {
+	return groupId + "/" + edgeNodeId + "/" + deviceId
+}
+
+// resolveAliases replaces the alias map and datatypes of a node or device on
+// BIRTH and fills in the names of metrics that only carry an alias in all other
+// messages, and the datatypes of metrics that don't carry one.
+func resolveAliases(msg *SparkplugMessage) {
+	if msg.Payload == nil {
+		return
+	}
+	key := deviceKey(msg.GroupId, msg.EdgeNodeId, msg.DeviceId)
+
+	if msg.Kind() == "BIRTH" {
+		aliases := make(map[uint64]string)
+		dataTypes := make(map[string]uint32)
+		for _, metric := range msg.Payload.Metrics {
+			if metric.Alias != nil && metric.Name != nil {
+				aliases[*metric.Alias] = *metric.Name
+			}
+			if metric.Datatype != nil && metric.Name != nil {
+				dataTypes[*metric.Name] = *metric.Datatype
+			}
+		}
+		aliasMapsMutex.Lock()
+		aliasMaps[key] = aliases
+		metricDataTypes[key] = dataTypes
+		aliasMapsMutex.Unlock()
+		return
+	}
+
+	aliasMapsMutex.RLock()
+	defer aliasMapsMutex.RUnlock()
+	aliases := aliasMaps[key]
+	dataTypes := metricDataTypes[key]
+	for _, metric := range msg.Payload.Metrics {
+		if metric.Name == nil && metric.Alias != nil {
+			name, ok := aliases[*metric.Alias]
+			if !ok {
+				unresolvedAliases.Add(1)
+				continue
+			}
+			metric.Name = proto.String(name)
+		}
+		if metric.Datatype == nil && metric.Name != nil {
+			if dataType, ok := dataTypes[*metric.Name]; ok {
+				metric.Datatype = proto.Uint32(dataType)
+			}
+		}
+	}
+}
+
+// loadAliasMaps restores the alias maps and the metric datatypes from the
+// last births in the birth table.
+func loadAliasMaps() error {
+	aliases, err := getMetricAliases()
+	if err != nil {
+		return err
+	}
+	dataTypes, err := getMetricDataTypes()
+	if err != nil {
+		return err
+	}
+	restoreAliasMaps(aliases, dataTypes)
+	log.Printf("Loaded %d metric aliases and datatypes of %d metrics.\n", len(aliases), len(dataTypes))
+	return nil
+}
+
+// restoreAliasMaps replaces the alias maps and the metric datatypes by those
+// of the metrics of the last births.
+func restoreAliasMaps(aliases []MetricAlias, dataTypes []MetricDataType) {
+	aliasMapsMutex.Lock()
+	defer aliasMapsMutex.Unlock()
+	aliasMaps = map[string]map[uint64]string{}
+	for _, alias := range aliases {
+		key := deviceKey(alias.GroupId, alias.EdgeNodeId, alias.DeviceId)
+		if aliasMaps[key] == nil {
+			aliasMaps[key] = make(map[uint64]string)
+		}
+		aliasMaps[key][alias.Alias] = alias.Name
+	}
+	metricDataTypes = map[string]map[string]uint32{}
+	for _, dataType := range dataTypes {
+		key := deviceKey(dataType.GroupId, dataType.EdgeNodeId, dataType.DeviceId)
+		if metricDataTypes[key] == nil {
+			metricDataTypes[key] = make(map[string]uint32)
+		}
+		metricDataTypes[key][dataType.Name] = dataType.DataType
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// aliasMetric is a metric with the given name and alias, "" or 0 for none.
+func aliasMetric(name string, alias uint64) *sparkplug_b.Payload_Metric {
+	metric := &sparkplug_b.Payload_Metric{}
+	if name != "" {
+		metric.Name = proto.String(name)
+	}
+	if alias != 0 {
+		metric.Alias = proto.Uint64(alias)
+	}
+	return metric
+}
+
+func TestResolveAliases(t *testing.T) {
+	defer restoreAliasMaps(nil, nil)
+	restoreAliasMaps(
+		[]MetricAlias{{"g", "n", "", "temperature", 1}, {"g", "n", "d", "pressure", 1}},
+		[]MetricDataType{{"g", "n", "", "temperature", 10}, {"g", "n", "d", "pressure", 9}},
+	)
+	message := func(messageType string, deviceId string, metrics ...*sparkplug_b.Payload_Metric) *SparkplugMessage {
+		return &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", DeviceId: deviceId, MessageType: messageType,
+			Payload: &sparkplug_b.Payload{Metrics: metrics}}
+	}
+	type want struct {
+		name     string // "" for unresolved
+		dataType uint32
+	}
+
+	tests := []struct {
+		name       string
+		msg        *SparkplugMessage
+		want       []want
+		unresolved int64
+	}{
+		{"restored node alias", message("NDATA", "", aliasMetric("", 1)), []want{{"temperature", 10}}, 0},
+		{"restored device alias", message("DDATA", "d", aliasMetric("", 1)), []want{{"pressure", 9}}, 0},
+		{"name without alias", message("NDATA", "", aliasMetric("temperature", 0)), []want{{"temperature", 10}}, 0},
+		{"unknown alias is kept", message("NDATA", "", aliasMetric("", 2), aliasMetric("", 1)),
+			[]want{{"", 0}, {"temperature", 10}}, 1},
+		{"unknown device", message("DDATA", "other", aliasMetric("", 1)), []want{{"", 0}}, 1},
+		{"node birth", message("NBIRTH", "", aliasMetric("humidity", 1), aliasMetric("temperature", 2)),
+			[]want{{"humidity", 0}, {"temperature", 0}}, 0},
+		{"alias reassigned by the birth", message("NDATA", "", aliasMetric("", 1), aliasMetric("", 2)),
+			[]want{{"humidity", 0}, {"temperature", 0}}, 0},
+		{"device birth drops aliases", message("DBIRTH", "d", aliasMetric("pressure", 0)), []want{{"pressure", 0}}, 0},
+		{"dropped alias", message("DDATA", "d", aliasMetric("", 1)), []want{{"", 0}}, 1},
+	}
+	for _, test := range tests {
+		before := unresolvedAliases.Load()
+		resolveAliases(test.msg)
+		if got := unresolvedAliases.Load() - before; got != test.unresolved {
+			t.Errorf("%s: %d unresolved aliases counted, want %d", test.name, got, test.unresolved)
+		}
+		if len(test.msg.Payload.Metrics) != len(test.want) {
+			t.Fatalf("%s: got %d metrics, want %d", test.name, len(test.msg.Payload.Metrics), len(test.want))
+		}
+		for i, want := range test.want {
+			metric := test.msg.Payload.Metrics[i]
+			if metric.GetName() != want.name || metric.GetDatatype() != want.dataType {
+				t.Errorf("%s: metric %d is %q of datatype %d, want %q of %d", test.name, i,
+					metric.GetName(), metric.GetDatatype(), want.name, want.dataType)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIError is the body of every error response of the JSON API.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func apiError(c echo.Context, status int, message string) error {
+	return c.JSON(status, APIError{Status: status, Message: message})
+}
+
+// isAPIRequest reports whether the request is handled by the JSON API,
+// so errors are reported as APIError instead of an HTML page.
+func isAPIRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().URL.Path, "/api/")
+}
+
+func apiNodeList(c echo.Context) error {
+	nodes, err := getNodes()
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch nodes")
+	}
+	if nodes == nil {
+		nodes = []NodeListEntry{}
+	}
+	return c.JSON(http.StatusOK, nodes)
+}
+
+func apiHostList(c echo.Context) error {
+	hosts, err := getHosts()
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch host applications")
+	}
+	if hosts == nil {
+		hosts = []HostListEntry{}
+	}
+	return c.JSON(http.StatusOK, hosts)
+}
+
+// APIStats are the counters of the ingestion since hostapp started.
+type APIStats struct {
+	UnresolvedAliases int64 `json:"unresolvedAliases"`
+}
+
+func apiStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, APIStats{UnresolvedAliases: unresolvedAliases.Load()})
+}
+
+func apiNodeInfo(c echo.Context) error {
+	node, err := getNodeInfo(c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiError(c, http.StatusNotFound, "Node or device not found")
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch node or device")
+	}
+	return c.JSON(http.StatusOK, node)
+}
+
+// apiNodeMetrics returns the last known value of every metric of a node or
+// device from the cache, or an empty list if it is offline.
+func apiNodeMetrics(c echo.Context) error {
+	groupId, nodeId, deviceId := c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId")
+	exists, err := nodeExists(groupId, nodeId, deviceId)
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch node or device")
+	}
+	if !exists {
+		return apiError(c, http.StatusNotFound, "Node or device not found")
+	}
+	return c.JSON(http.StatusOK, getLKV(groupId, nodeId, deviceId))
+}
+
+const (
+	defaultHistoryRange     = time.Hour
+	defaultHistoryMaxPoints = 1000
+	maxHistoryMaxPoints     = 100000
+)
+
+// HistoryResponse is the body returned by apiMetricHistory.
+type HistoryResponse struct {
+	Metric    string         `json:"metric"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Aggregate string         `json:"aggregate,omitempty"`
+	Bucket    string         `json:"bucket,omitempty"`
+	Fill      string         `json:"fill,omitempty"`
+	Points    []HistoryPoint `json:"points"`
+	Truncated bool           `json:"truncated"`      // more points than maxPoints in the range
+	Next      *time.Time     `json:"next,omitempty"` // from of the request for the following points
+}
+
+// apiMetricHistory returns the history of the metric given by the query
+// parameter "metric" in the range [from, to) (RFC 3339, default the last hour).
+//
+// Values are placed at the time they were measured. Without "aggregate" (or
+// with "aggregate=raw") the stored values are returned, at most "maxPoints" of
+// them (default 1000); if there are more, "truncated" is set and "next" is
+// the from of the request for the following ones. "aggregate" avg, min, max,
+// last or count aggregates them into buckets sized so the range fits into
+// maxPoints points, "bucket" (e.g. 5m) sets the bucket width, which is widened
+// if the range would not fit into maxPoints buckets. "fill" (null, locf or
+// interpolate) returns a point for every bucket, including empty ones.
+func apiMetricHistory(c echo.Context) error {
+	q := HistoryQuery{
+		GroupId:    c.Param("groupId"),
+		EdgeNodeId: c.Param("nodeId"),
+		DeviceId:   c.Param("deviceId"),
+		Metric:     c.QueryParam("metric"),
+		Aggregate:  c.QueryParam("aggregate"),
+		Fill:       c.QueryParam("fill"),
+		MaxPoints:  defaultHistoryMaxPoints,
+	}
+	if q.Metric == "" {
+		return apiError(c, http.StatusBadRequest, "Query parameter metric is required")
+	}
+
+	var err error
+	q.To = time.Now()
+	if to := c.QueryParam("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339Nano, to); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid to: "+err.Error())
+		}
+	}
+	q.From = q.To.Add(-defaultHistoryRange)
+	if from := c.QueryParam("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339Nano, from); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid from: "+err.Error())
+		}
+	}
+	if !q.From.Before(q.To) {
+		return apiError(c, http.StatusBadRequest, "from must be before to")
+	}
+
+	if maxPoints := c.QueryParam("maxPoints"); maxPoints != "" {
+		q.MaxPoints, err = strconv.Atoi(maxPoints)
+		if err != nil || q.MaxPoints < 1 || q.MaxPoints > maxHistoryMaxPoints {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("maxPoints must be between 1 and %d", maxHistoryMaxPoints))
+		}
+	}
+
+	switch q.Aggregate {
+	case "", "raw":
+		q.Aggregate = ""
+		if q.Fill != "" {
+			return apiError(c, http.StatusBadRequest, "fill requires an aggregate")
+		}
+		if c.QueryParam("bucket") != "" {
+			return apiError(c, http.StatusBadRequest, "bucket requires an aggregate")
+		}
+	default:
+		if _, ok := historyAggregates[q.Aggregate]; !ok {
+			return apiError(c, http.StatusBadRequest, "aggregate must be one of raw, avg, min, max, last, count")
+		}
+	}
+	if _, ok := historyFills[q.Fill]; q.Fill != "" && !ok {
+		return apiError(c, http.StatusBadRequest, "fill must be one of null, locf, interpolate")
+	}
+
+	if q.Aggregate != "" {
+		if bucket := c.QueryParam("bucket"); bucket != "" {
+			q.Bucket, err = time.ParseDuration(bucket)
+			if err != nil || q.Bucket <= 0 {
+				return apiError(c, http.StatusBadRequest, "Invalid bucket, expected a duration like 30s or 5m")
+			}
+		}
+		q.Bucket = historyBucket(q.From, q.To, q.Bucket, q.MaxPoints)
+	}
+
+	points, truncated, err := getMetricHistory(q)
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch metric history")
+	}
+
+	response := HistoryResponse{
+		Metric:    q.Metric,
+		From:      q.From,
+		To:        q.To,
+		Aggregate: q.Aggregate,
+		Fill:      q.Fill,
+		Points:    points,
+		Truncated: truncated,
+	}
+	if truncated {
+		response.Points, response.Next = historyPage(points)
+	}
+	if q.Aggregate != "" {
+		response.Bucket = q.Bucket.String()
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// historyBucket widens bucket to whole milliseconds until the range [from,
+// to) fits into maxPoints buckets.
+func historyBucket(from time.Time, to time.Time, bucket time.Duration, maxPoints int) time.Duration {
+	minBucket := (to.Sub(from) + time.Duration(maxPoints) - 1) / time.Duration(maxPoints)
+	if bucket < minBucket {
+		bucket = minBucket.Round(time.Millisecond)
+		if bucket < minBucket {
+			bucket += time.Millisecond
+		}
+	}
+	return bucket
+}
+
+// historyPage cuts the points of a truncated history before the time of its
+// last point, so the request for the following points starting at that time
+// does not return any of them again. A page of points of a single time is
+// returned as is, the following request then starts after that time.
+func historyPage(points []HistoryPoint) ([]HistoryPoint, *time.Time) {
+	next := points[len(points)-1].Time
+	i := len(points)
+	for i > 0 && points[i-1].Time.Equal(next) {
+		i--
+	}
+	if i == 0 {
+		next = next.Add(time.Microsecond)
+		return points, &next
+	}
+	return points[:i], &next
+}
+
+// apiSessionHistory returns the availability of a node or device in the range
+// [from, to) (RFC 3339, default the last 24 hours).
+func apiSessionHistory(c echo.Context) error {
+	var err error
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid to: "+err.Error())
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid from: "+err.Error())
+		}
+	}
+	if !from.Before(to) {
+		return apiError(c, http.StatusBadRequest, "from must be before to")
+	}
+
+	events, err := getSessionHistory(c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId"), from, to)
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch session history")
+	}
+	return c.JSON(http.StatusOK, computeAvailability(events, from, to))
+}
+
+const (
+	defaultMessagesRange = time.Hour
+	defaultMessagesLimit = 1000
+	maxMessagesLimit     = 100000
+)
+
+// apiStoredMessages lists the messages of a node or device stored in the range
+// [from, to) (RFC 3339, default the last hour), at most "limit" of them.
+func apiStoredMessages(c echo.Context) error {
+	var err error
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid to: "+err.Error())
+		}
+	}
+	from := to.Add(-defaultMessagesRange)
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "Invalid from: "+err.Error())
+		}
+	}
+	if !from.Before(to) {
+		return apiError(c, http.StatusBadRequest, "from must be before to")
+	}
+	limit := defaultMessagesLimit
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxMessagesLimit {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxMessagesLimit))
+		}
+	}
+
+	messages, err := getStoredMessages(c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId"), from, to, limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch messages")
+	}
+	return c.JSON(http.StatusOK, messages)
+}
+
+// apiRawPayload downloads the encoded Sparkplug payload of the message given by
+// the query parameter "receivedAt" (RFC 3339, as listed by apiStoredMessages).
+// Payloads are only stored with -storeRawPayload.
+func apiRawPayload(c echo.Context) error {
+	receivedAt, err := time.Parse(time.RFC3339Nano, c.QueryParam("receivedAt"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "Invalid receivedAt: "+err.Error())
+	}
+	body, err := getRawPayload(c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId"), receivedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiError(c, http.StatusNotFound, "Message not found")
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot fetch message")
+	}
+	if body == nil {
+		return apiError(c, http.StatusNotFound, "No raw payload stored for this message")
+	}
+	payload, err := decodeRawPayloadBody(body)
+	if err != nil {
+		c.Logger().Error(err)
+		return apiError(c, http.StatusInternalServerError, "Cannot decompress the raw payload")
+	}
+
+	fileName := fmt.Sprintf("%s-%d.pb", c.Param("nodeId"), receivedAt.UnixMicro())
+	if deviceId := c.Param("deviceId"); deviceId != "" {
+		fileName = fmt.Sprintf("%s-%s-%d.pb", c.Param("nodeId"), deviceId, receivedAt.UnixMicro())
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	return c.Blob(http.StatusOK, "application/x-protobuf", payload)
+}
+
+// registerAPIRoutes adds the routes of the versioned JSON API. Devices are
+// addressed below their edge node as /nodes/<group>/<node>/devices/<device>,
+// so device names cannot collide with the endpoints of the edge node.
+func registerAPIRoutes(e *echo.Echo) {
+	api := e.Group("/api/v1")
+	api.GET("/hosts", apiHostList)
+	api.GET("/nodes", apiNodeList)
+	api.GET("/stats", apiStats)
+	for _, prefix := range []string{"/nodes/:groupId/:nodeId", "/nodes/:groupId/:nodeId/devices/:deviceId"} {
+		api.GET(prefix, apiNodeInfo)
+		api.GET(prefix+"/metrics", apiNodeMetrics)
+		api.GET(prefix+"/history", apiMetricHistory)
+		api.GET(prefix+"/live", serveLiveUpdates)
+		api.GET(prefix+"/sessions", apiSessionHistory)
+		api.GET(prefix+"/messages", apiStoredMessages)
+		api.GET(prefix+"/messages/raw", apiRawPayload)
+	}
+}
+
+// apiNodePath returns the path of a node or device below /api/v1.
+func apiNodePath(groupId string, nodeId string, deviceId string) string {
+	path := "/nodes/" + url.PathEscape(groupId) + "/" + url.PathEscape(nodeId)
+	if deviceId != "" {
+		path += "/devices/" + url.PathEscape(deviceId)
+	}
+	return path
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func TestHistoryPage(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds ...int) []HistoryPoint {
+		points := make([]HistoryPoint, len(seconds))
+		for i, s := range seconds {
+			points[i].Time = t0.Add(time.Duration(s) * time.Second)
+		}
+		return points
+	}
+	tests := []struct {
+		name   string
+		points []HistoryPoint
+		want   int
+		next   time.Time
+	}{
+		{"distinct times", at(1, 2, 3), 2, t0.Add(3 * time.Second)},
+		{"last time repeated", at(1, 2, 3, 3), 2, t0.Add(3 * time.Second)},
+		{"single time", at(1, 1, 1), 3, t0.Add(time.Second + time.Microsecond)},
+	}
+	for _, test := range tests {
+		points, next := historyPage(test.points)
+		if len(points) != test.want || next == nil || !next.Equal(test.next) {
+			t.Errorf("%s: got %d points, next %v, want %d, %v", test.name, len(points), next, test.want, test.next)
+		}
+	}
+}
+
+// fakeDB answers the queries of the API handlers with the birth of every node
+// and device in it, keyed by deviceKey.
+type fakeDB map[string]bool
+
+func (f fakeDB) Open(string) (driver.Conn, error)             { return f, nil }
+func (f fakeDB) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f fakeDB) Driver() driver.Driver                        { return f }
+func (f fakeDB) Prepare(string) (driver.Stmt, error)          { return nil, driver.ErrSkip }
+func (f fakeDB) Close() error                                 { return nil }
+func (f fakeDB) Begin() (driver.Tx, error)                    { return nil, driver.ErrSkip }
+
+func (f fakeDB) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "SELECT DISTINCT ON") {
+		// the latest value of metric "m" of every node and device
+		rows := &fakeRows{columns: []string{"group_id", "edge_node_id", "device_id", "received_at", "to_jsonb"}}
+		for key := range f {
+			ids := strings.Split(key, "/")
+			rows.rows = append(rows.rows, []driver.Value{ids[0], ids[1], ids[2], historyStart, []byte(`{"name":"m","datatype":4,"value_long":1}`)})
+		}
+		return rows, nil
+	}
+	key := deviceKey(args[0].Value.(string), args[1].Value.(string), args[2].Value.(string))
+	switch {
+	case strings.Contains(query, "SELECT EXISTS"):
+		return &fakeRows{columns: []string{"exists"}, rows: [][]driver.Value{{f[key]}}}, nil
+	case strings.Contains(query, "to_jsonb(b.metrics)"):
+		rows := &fakeRows{columns: []string{"last_birth", "last_death", "metrics"}}
+		if f[key] {
+			rows.rows = [][]driver.Value{{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), nil, []byte("[]")}}
+		}
+		return rows, nil
+	case strings.Contains(query, "FROM data AS d"):
+		// one point a second from historyStart, at most LIMIT of them
+		rows := &fakeRows{columns: []string{"time", "value"}}
+		for i := int64(0); i < 3 && i < args[6].Value.(int64); i++ {
+			rows.rows = append(rows.rows, []driver.Value{historyStart.Add(time.Duration(i) * time.Second), float64(i)})
+		}
+		return rows, nil
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+var historyStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestAPIRoutes(t *testing.T) {
+	defer func(saved *sqlx.DB) { db = saved }(db)
+	db = sqlx.NewDb(sql.OpenDB(fakeDB{"g/n/": true, "g/n/d": true}), "pgx")
+
+	lkvCacheMutex.Lock()
+	lkvCache[deviceKey("g", "n", "")] = map[string]MetricValue{"node metric": {Metric: Metric{Name: "node metric"}}}
+	lkvCache[deviceKey("g", "n", "d")] = map[string]MetricValue{"device metric": {Metric: Metric{Name: "device metric"}}}
+	lkvCacheMutex.Unlock()
+	defer func() {
+		lkvCacheMutex.Lock()
+		delete(lkvCache, deviceKey("g", "n", ""))
+		delete(lkvCache, deviceKey("g", "n", "d"))
+		lkvCacheMutex.Unlock()
+	}()
+
+	defer unresolvedAliases.Store(unresolvedAliases.Load())
+	unresolvedAliases.Store(2)
+
+	e := echo.New()
+	e.HTTPErrorHandler = customHTTPErrorHandler
+	registerAPIRoutes(e)
+
+	notFound := `{"status":404,"message":"Node or device not found"}`
+	tests := []struct {
+		path   string
+		status int
+		body   string // contained in the response
+	}{
+		{"/api/v1/stats", http.StatusOK, `{"unresolvedAliases":2}`},
+		{"/api/v1/nodes/g/n", http.StatusOK, `"deviceId":""`},
+		{"/api/v1/nodes/g/n/devices/d", http.StatusOK, `"deviceId":"d"`},
+		{"/api/v1/nodes/g/n/metrics", http.StatusOK, `"name":"node metric"`},
+		{"/api/v1/nodes/g/n/devices/d/metrics", http.StatusOK, `"name":"device metric"`},
+		{"/api/v1/nodes/g/x", http.StatusNotFound, notFound},
+		{"/api/v1/nodes/g/x/metrics", http.StatusNotFound, notFound},
+		{"/api/v1/nodes/g/n/devices/x", http.StatusNotFound, notFound},
+		{"/api/v1/nodes/g/n/devices/x/metrics", http.StatusNotFound, notFound},
+		{"/api/v1/nodes/g/n/devices", http.StatusNotFound, `{"status":404,"message":"Not Found"}`},
+		{"/api/v1/nodes/g/n/history", http.StatusBadRequest, `{"status":400,"message":"Query parameter metric is required"}`},
+		{"/api/v1/nodes/g/n/devices/d/history?metric=m&bucket=5m", http.StatusBadRequest, `{"status":400,"message":"bucket requires an aggregate"}`},
+		{"/api/v1/nodes/g/n/history?metric=m&aggregate=median", http.StatusBadRequest, `{"status":400,"message":"aggregate must be one of raw, avg, min, max, last, count"}`},
+		{"/api/v1/nodes/g/n/messages/raw?receivedAt=yesterday", http.StatusBadRequest, `"status":400`},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.body) {
+			t.Errorf("%s: got %d %s, want %d %s", test.path, rec.Code, rec.Body.String(), test.status, test.body)
+		}
+	}
+}
+
+func TestHistoryBucket(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		window    time.Duration
+		bucket    time.Duration
+		maxPoints int
+		want      time.Duration
+	}{
+		{"default bucket", time.Hour, 0, 1000, 3600 * time.Millisecond},
+		{"bucket fits", time.Hour, 5 * time.Minute, 1000, 5 * time.Minute},
+		{"bucket exactly fits", time.Hour, time.Minute, 60, time.Minute},
+		{"bucket widened", 24 * time.Hour, time.Second, 1000, 86400 * time.Millisecond},
+		{"rounded up to milliseconds", time.Hour, 0, 7, 514286 * time.Millisecond},
+		{"at least a millisecond", time.Millisecond, 0, 1000, time.Millisecond},
+		{"single point", time.Hour, time.Second, 1, time.Hour},
+	}
+	for _, test := range tests {
+		got := historyBucket(from, from.Add(test.window), test.bucket, test.maxPoints)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if buckets := (test.window + got - 1) / got; int(buckets) > test.maxPoints {
+			t.Errorf("%s: %d buckets of %v, want at most %d", test.name, buckets, got, test.maxPoints)
+		}
+	}
+}
+
+func TestMetricHistoryQuery(t *testing.T) {
+	q := HistoryQuery{Metric: "m", From: historyStart, To: historyStart.Add(time.Hour), MaxPoints: 10, Bucket: time.Minute}
+	tests := []struct {
+		aggregate string
+		fill      string
+		contains  []string
+		args      int
+	}{
+		{"", "", []string{metricValueExpr + ` AS value`}, 8},
+		{"avg", "", []string{"time_bucket($9::interval,", "avg(", "GROUP BY 1"}, 9},
+		{"last", "null", []string{"time_bucket_gapfill($9::interval,", "last(", "GROUP BY 1"}, 9},
+		{"max", "locf", []string{"time_bucket_gapfill($9::interval,", "locf(max(", "GROUP BY 1"}, 9},
+	}
+	for _, test := range tests {
+		q.Aggregate, q.Fill = test.aggregate, test.fill
+		query, args := metricHistoryQuery(q)
+		for _, s := range test.contains {
+			if !strings.Contains(query, s) {
+				t.Errorf("%q/%q: query does not contain %q", test.aggregate, test.fill, s)
+			}
+		}
+		if test.aggregate == "" && strings.Contains(query, "GROUP BY") {
+			t.Errorf("raw query is grouped")
+		}
+		if len(args) != test.args || args[6] != 11 {
+			t.Errorf("%q/%q: got args %v, want %d with limit 11", test.aggregate, test.fill, args, test.args)
+		}
+		if test.aggregate != "" && args[8] != "60000000 microseconds" {
+			t.Errorf("%q/%q: got bucket %v", test.aggregate, test.fill, args[8])
+		}
+	}
+}
+
+func TestMetricHistory(t *testing.T) {
+	defer func(saved *sqlx.DB) { db = saved }(db)
+	db = sqlx.NewDb(sql.OpenDB(fakeDB{}), "pgx")
+
+	e := echo.New()
+	registerAPIRoutes(e)
+
+	second := historyStart.Add(time.Second)
+	tests := []struct {
+		name      string
+		query     string
+		points    int
+		truncated bool
+		next      *time.Time
+		bucket    string
+	}{
+		{"raw", "", 3, false, nil, ""},
+		{"raw truncated", "&maxPoints=2", 1, true, &second, ""},
+		{"aggregated", "&aggregate=avg", 3, false, nil, "3.6s"},
+		{"aggregated bucket", "&aggregate=avg&bucket=5m", 3, false, nil, "5m0s"},
+	}
+	for _, test := range tests {
+		path := "/api/v1/nodes/g/n/history?metric=m&from=2026-01-01T00:00:00Z&to=2026-01-01T01:00:00Z" + test.query
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var response HistoryResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", test.name, rec.Code, rec.Body.String())
+			continue
+		}
+		if len(response.Points) != test.points || response.Truncated != test.truncated || response.Bucket != test.bucket ||
+			(response.Next == nil) != (test.next == nil) || (test.next != nil && !response.Next.Equal(*test.next)) {
+			t.Errorf("%s: got %s", test.name, rec.Body.String())
+		}
+	}
+}
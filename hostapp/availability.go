@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+)
+
+// SessionEvent is a state transition of a node or device recorded in session_history.
+type SessionEvent struct {
+	Event      string    `json:"event"`
+	State      string    `json:"state"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// sessionStates maps the events of session_history to the state they start.
+var sessionStates = map[string]string{
+	"BIRTH":   nodeStateOnline,
+	"DEATH":   nodeStateOffline,
+	"UNKNOWN": nodeStateUnknown,
+	"STALE":   nodeStateStale,
+	"ACTIVE":  nodeStateOnline,
+}
+
+// sessionWindows are the windows the availability of a node can be shown for on the node page.
+var sessionWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+const defaultSessionWindow = "24h"
+
+// TimelineSegment is a time range a node or device spent in one state.
+type TimelineSegment struct {
+	State   string    `json:"state"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Percent float64   `json:"percent"` // share of the window
+}
+
+// Availability is the session history of a node or device in a window.
+type Availability struct {
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Seconds  map[string]float64 `json:"seconds"` // time spent in each state
+	Uptime   *float64           `json:"uptime"`  // percent of the time with a known state spent online
+	Timeline []TimelineSegment  `json:"timeline"`
+	Events   []SessionEvent     `json:"events"` // transitions within the window
+}
+
+// computeAvailability splits the window [from, to) into the states started by
+// the given events, which are sorted by time and may start before from. The
+// state before the first event is unknown.
+func computeAvailability(events []SessionEvent, from time.Time, to time.Time) Availability {
+	a := Availability{
+		From:     from,
+		To:       to,
+		Seconds:  map[string]float64{},
+		Timeline: []TimelineSegment{},
+		Events:   []SessionEvent{},
+	}
+	window := to.Sub(from)
+	if window <= 0 {
+		return a
+	}
+
+	addSegment := func(state string, start time.Time, end time.Time) {
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !start.Before(end) {
+			return
+		}
+		d := end.Sub(start)
+		a.Seconds[state] += d.Seconds()
+		if n := len(a.Timeline); n > 0 && a.Timeline[n-1].State == state {
+			a.Timeline[n-1].To = end
+			a.Timeline[n-1].Percent += 100 * float64(d) / float64(window)
+			return
+		}
+		a.Timeline = append(a.Timeline, TimelineSegment{
+			State:   state,
+			From:    start,
+			To:      end,
+			Percent: 100 * float64(d) / float64(window),
+		})
+	}
+
+	state, start := nodeStateUnknown, from
+	for _, event := range events {
+		if !event.ReceivedAt.Before(from) {
+			a.Events = append(a.Events, event)
+		}
+		addSegment(state, start, event.ReceivedAt)
+		state, start = event.State, event.ReceivedAt
+	}
+	addSegment(state, start, to)
+
+	known := window.Seconds() - a.Seconds[nodeStateUnknown]
+	if known > 0 {
+		uptime := 100 * a.Seconds[nodeStateOnline] / known
+		a.Uptime = &uptime
+	}
+	return a
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeAvailability(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(hours float64) time.Time { return from.Add(time.Duration(hours * float64(time.Hour))) }
+	event := func(name string, hours float64) SessionEvent {
+		return SessionEvent{Event: name, State: sessionStates[name], ReceivedAt: at(hours)}
+	}
+	type segment struct {
+		state    string
+		from, to float64 // hours after from
+	}
+
+	tests := []struct {
+		name     string
+		events   []SessionEvent
+		segments []segment
+		uptime   float64 // -1 for none
+		inWindow int     // events within the window
+	}{
+		{"empty history", nil,
+			[]segment{{nodeStateUnknown, 0, 10}}, -1, 0},
+		{"session started before the window", []SessionEvent{event("BIRTH", -5)},
+			[]segment{{nodeStateOnline, 0, 10}}, 100, 0},
+		{"session ended before the window", []SessionEvent{event("BIRTH", -5), event("DEATH", -1)},
+			[]segment{{nodeStateOffline, 0, 10}}, 0, 0},
+		{"session open at the end of the window", []SessionEvent{event("BIRTH", 6)},
+			[]segment{{nodeStateUnknown, 0, 6}, {nodeStateOnline, 6, 10}}, 100, 1},
+		{"session across the whole window", []SessionEvent{event("BIRTH", -1), event("DEATH", 8), event("BIRTH", 9)},
+			[]segment{{nodeStateOnline, 0, 8}, {nodeStateOffline, 8, 9}, {nodeStateOnline, 9, 10}}, 90, 2},
+		{"stale and active", []SessionEvent{event("BIRTH", 0), event("STALE", 2), event("ACTIVE", 4)},
+			[]segment{{nodeStateOnline, 0, 2}, {nodeStateStale, 2, 4}, {nodeStateOnline, 4, 10}}, 80, 3},
+		{"repeated state merges", []SessionEvent{event("BIRTH", 0), event("BIRTH", 5)},
+			[]segment{{nodeStateOnline, 0, 10}}, 100, 2},
+	}
+	for _, test := range tests {
+		a := computeAvailability(test.events, from, to)
+		if len(a.Timeline) != len(test.segments) {
+			t.Errorf("%s: got %d segments %+v, want %d", test.name, len(a.Timeline), a.Timeline, len(test.segments))
+			continue
+		}
+		var percent float64
+		for i, want := range test.segments {
+			got := a.Timeline[i]
+			if got.State != want.state || !got.From.Equal(at(want.from)) || !got.To.Equal(at(want.to)) {
+				t.Errorf("%s: segment %d is %v %v-%v, want %v %v-%v", test.name, i,
+					got.State, got.From, got.To, want.state, at(want.from), at(want.to))
+			}
+			percent += got.Percent
+		}
+		if percent < 99.999 || percent > 100.001 {
+			t.Errorf("%s: segments cover %v%% of the window", test.name, percent)
+		}
+		switch {
+		case test.uptime < 0 && a.Uptime != nil:
+			t.Errorf("%s: got uptime %v, want none", test.name, *a.Uptime)
+		case test.uptime >= 0 && (a.Uptime == nil || *a.Uptime < test.uptime-0.001 || *a.Uptime > test.uptime+0.001):
+			t.Errorf("%s: got uptime %v, want %v", test.name, a.Uptime, test.uptime)
+		}
+		if len(a.Events) != test.inWindow {
+			t.Errorf("%s: got %d events, want %d", test.name, len(a.Events), test.inWindow)
+		}
+	}
+}
+
+func TestComputeAvailabilityEmptyWindow(t *testing.T) {
+	now := time.Now()
+	a := computeAvailability([]SessionEvent{{Event: "BIRTH", State: nodeStateOnline, ReceivedAt: now}}, now, now)
+	if a.Uptime != nil || len(a.Timeline) != 0 || len(a.Events) != 0 {
+		t.Errorf("got %+v for an empty window", a)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"hostapp/sparkplug_b"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandSubject returns the NATS subject of spBv1.0/<group>/NCMD/<node> or,
+// if deviceId is set, spBv1.0/<group>/DCMD/<node>/<device>.
+func commandSubject(groupId string, edgeNodeId string, deviceId string) string {
+	return messageSubject("CMD", groupId, edgeNodeId, deviceId)
+}
+
+// publishCommand publishes an NCMD (or DCMD if deviceId is set) with the given metrics.
+func publishCommand(groupId string, edgeNodeId string, deviceId string, metrics []*sparkplug_b.Payload_Metric) error {
+	payload := &sparkplug_b.Payload{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Metrics:   metrics,
+	}
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return natsCon.Publish(commandSubject(groupId, edgeNodeId, deviceId), data)
+}
+
+// publishRebirth asks an edge node to publish its NBIRTH and DBIRTHs again.
+func publishRebirth(groupId string, edgeNodeId string) error {
+	log.Printf("Requesting rebirth of %v/%v.\n", groupId, edgeNodeId)
+	return publishCommand(groupId, edgeNodeId, "", []*sparkplug_b.Payload_Metric{
+		{
+			Name:      proto.String("Node Control/Rebirth"),
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+			Datatype:  proto.Uint32(11),
+			Value:     &sparkplug_b.Payload_Metric_BooleanValue{BooleanValue: true},
+		},
+	})
+}
+
+// commandTimeLayouts are the accepted formats of DateTime command values.
+// The first two are produced by <input type="datetime-local"> and are interpreted as UTC.
+var commandTimeLayouts = []string{
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+}
+
+// commandMetric builds the metric of a command that writes value to a metric
+// announced in the last birth. The value is converted according to the datatype
+// of the metric, the alias of the birth is used if there was one.
+func commandMetric(metric Metric, value string) (*sparkplug_b.Payload_Metric, error) {
+	cmd := &sparkplug_b.Payload_Metric{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Datatype:  proto.Uint32(uint32(metric.DataType)),
+	}
+	if metric.Alias != nil {
+		cmd.Alias = proto.Uint64(uint64(*metric.Alias))
+	} else {
+		cmd.Name = proto.String(metric.Name)
+	}
+
+	trimmed := strings.TrimSpace(value)
+	var err error
+	switch metric.DataType {
+	case 1, 2, 3: // Int8, Int16, Int32
+		var v int64
+		v, err = strconv.ParseInt(trimmed, 10, 8<<(metric.DataType-1))
+		cmd.Value = &sparkplug_b.Payload_Metric_IntValue{IntValue: uint32(int32(v))}
+	case 4: // Int64
+		var v int64
+		v, err = strconv.ParseInt(trimmed, 10, 64)
+		cmd.Value = &sparkplug_b.Payload_Metric_LongValue{LongValue: uint64(v)}
+	case 5, 6, 7: // UInt8, UInt16, UInt32
+		var v uint64
+		v, err = strconv.ParseUint(trimmed, 10, 8<<(metric.DataType-5))
+		cmd.Value = &sparkplug_b.Payload_Metric_IntValue{IntValue: uint32(v)}
+	case 8: // UInt64
+		var v uint64
+		v, err = strconv.ParseUint(trimmed, 10, 64)
+		cmd.Value = &sparkplug_b.Payload_Metric_LongValue{LongValue: v}
+	case 9: // Float
+		var v float64
+		v, err = strconv.ParseFloat(trimmed, 32)
+		cmd.Value = &sparkplug_b.Payload_Metric_FloatValue{FloatValue: float32(v)}
+	case 10: // Double
+		var v float64
+		v, err = strconv.ParseFloat(trimmed, 64)
+		cmd.Value = &sparkplug_b.Payload_Metric_DoubleValue{DoubleValue: v}
+	case 11: // Boolean, an unchecked checkbox is not submitted at all
+		v := false
+		if trimmed != "" {
+			v, err = strconv.ParseBool(trimmed)
+		}
+		cmd.Value = &sparkplug_b.Payload_Metric_BooleanValue{BooleanValue: v}
+	case 12, 14, 15: // String, Text, UUID
+		cmd.Value = &sparkplug_b.Payload_Metric_StringValue{StringValue: value}
+	case 13: // DateTime
+		var t time.Time
+		err = errors.New("expected a date and time like 2006-01-02T15:04:05")
+		for _, layout := range commandTimeLayouts {
+			if parsed, parseErr := time.Parse(layout, trimmed); parseErr == nil {
+				t, err = parsed, nil
+				break
+			}
+		}
+		cmd.Value = &sparkplug_b.Payload_Metric_LongValue{LongValue: uint64(t.UnixMilli())}
+	default:
+		return nil, fmt.Errorf("writing metrics of type %v is not supported", DataTypes[int(metric.DataType)])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v value %q for metric %q: %w", DataTypes[int(metric.DataType)], value, metric.Name, err)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCommandMetric(t *testing.T) {
+	tests := []struct {
+		datatype int32
+		value    string
+		want     interface{} // the value of the command metric, nil if value is invalid
+	}{
+		{1, "-128", uint32(0xffffff80)},
+		{1, "127", uint32(127)},
+		{1, "128", nil},
+		{1, "-129", nil},
+		{2, "-32768", uint32(0xffff8000)},
+		{2, "32768", nil},
+		{3, " 2147483647 ", uint32(math.MaxInt32)},
+		{3, "-2147483648", uint32(1 << 31)},
+		{3, "2147483648", nil},
+		{3, "1.5", nil},
+		{4, "-9223372036854775808", uint64(1 << 63)},
+		{4, "9223372036854775808", nil},
+		{5, "255", uint32(255)},
+		{5, "256", nil},
+		{5, "-1", nil},
+		{6, "65535", uint32(65535)},
+		{6, "65536", nil},
+		{7, "4294967295", uint32(math.MaxUint32)},
+		{7, "4294967296", nil},
+		{8, "18446744073709551615", uint64(math.MaxUint64)},
+		{8, "18446744073709551616", nil},
+		{8, "-1", nil},
+		{9, "1.5", float32(1.5)},
+		{9, "1e39", nil},
+		{10, "-2.25e300", -2.25e300},
+		{10, "abc", nil},
+		{11, "true", true},
+		{11, "", false},
+		{11, "yes", nil},
+		{12, " text with spaces ", " text with spaces "},
+		{13, "2023-11-14T22:13", uint64(1699999980000)},
+		{13, "2023-11-14T22:13:20", uint64(1700000000000)},
+		{13, "2023-11-14T23:13:20.123+01:00", uint64(1700000000123)},
+		{13, "yesterday", nil},
+		{16, "", nil},
+		{22, "[1]", nil},
+	}
+	for _, test := range tests {
+		metric := Metric{Name: "m", DataType: test.datatype}
+		cmd, err := commandMetric(metric, test.value)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%v %q: got %v, expected an error", DataTypes[int(test.datatype)], test.value, cmd.GetValue())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %q: %v", DataTypes[int(test.datatype)], test.value, err)
+			continue
+		}
+		var got interface{}
+		switch v := cmd.GetValue().(type) {
+		case *sparkplug_b.Payload_Metric_IntValue:
+			got = v.IntValue
+		case *sparkplug_b.Payload_Metric_LongValue:
+			got = v.LongValue
+		case *sparkplug_b.Payload_Metric_FloatValue:
+			got = v.FloatValue
+		case *sparkplug_b.Payload_Metric_DoubleValue:
+			got = v.DoubleValue
+		case *sparkplug_b.Payload_Metric_BooleanValue:
+			got = v.BooleanValue
+		case *sparkplug_b.Payload_Metric_StringValue:
+			got = v.StringValue
+		}
+		if got != test.want {
+			t.Errorf("%v %q: got %v (%T), want %v (%T)", DataTypes[int(test.datatype)], test.value, got, got, test.want, test.want)
+		}
+		if cmd.GetDatatype() != uint32(test.datatype) || cmd.GetName() != "m" || cmd.Alias != nil {
+			t.Errorf("%v %q: got datatype %v name %q alias %v", DataTypes[int(test.datatype)], test.value,
+				cmd.GetDatatype(), cmd.GetName(), cmd.Alias)
+		}
+	}
+}
+
+func TestCommandMetricAlias(t *testing.T) {
+	cmd, err := commandMetric(Metric{Name: "m", Alias: proto.Int64(7), DataType: 3}, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Name != nil || cmd.GetAlias() != 7 {
+		t.Errorf("got name %v alias %v, want only alias 7", cmd.Name, cmd.Alias)
+	}
+	if ts := time.UnixMilli(int64(cmd.GetTimestamp())); time.Since(ts) > time.Minute {
+		t.Errorf("timestamp: got %v", ts)
+	}
+}
@@ -2,20 +2,36 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/jackc/pgtype"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4/stdlib"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
-	"html/template"
+	"hostapp/sparkplug_b"
 	"log"
-	"strings"
+	"math"
+	"strconv"
 	"time"
 )
 
-var sqlTemplate *template.Template = nil
 var db *sqlx.DB
 
+// copyDataQuery writes the messages of a batch to the data hypertable.
+// The rows are encoded by writeDataCopyRow.
+const copyDataQuery = `COPY data (message_type, received_at, group_id, edge_node_id, device_id, timestamp, seq, uuid, body, metrics) FROM STDIN`
+
+// insertIgnoredDeathQuery records an NDEATH whose bdSeq does not match the current session.
+const insertIgnoredDeathQuery = `
+	INSERT INTO ignored_death
+		(group_id, edge_node_id, device_id, "timestamp", bd_seq, expected_bd_seq, received_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+// updateHostStateQuery stores the STATE of a host application.
+const updateHostStateQuery = `CALL update_host_state($1, $2, $3, $4)`
+
+// updateSparkplugStateQuery updates birth, death and metrics_info for a BIRTH or DEATH message.
+const updateSparkplugStateQuery = `CALL update_sparkplug_state($1, $2::message_type, $3, $4, $5, $6::text::metric_type[], $7)`
+
 func connectDB(postgresUrl string) error {
 	log.Printf("Connecting to PostgreSQL on URL %v.\n", postgresUrl)
 	var err error
@@ -30,34 +46,383 @@ func disconnectDB() error {
 	return db.Close()
 }
 
-func storeSparkplugMessageToDB(sparkplugMessage *SparkplugMessage) error {
-
-	var buffer bytes.Buffer
-	err := sqlTemplate.Execute(&buffer, sparkplugMessage)
+// storeSparkplugBatchToDB writes a batch of messages in a single transaction.
+// All edge node messages are copied to the data table, births and deaths additionally
+// update the birth, death and metrics_info tables. STATE messages of host
+// applications only update the host_state table.
+func storeSparkplugBatchToDB(batch []ingestItem) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+		tx, err := pgxConn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		var buffer bytes.Buffer
+		for _, item := range batch {
+			if item.msg.Kind() != "STATE" {
+				writeDataCopyRow(&buffer, item)
+			}
+		}
+		if buffer.Len() > 0 {
+			_, err = tx.Conn().PgConn().CopyFrom(ctx, &buffer, copyDataQuery)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, item := range batch {
+			switch {
+			case item.ignoredDeath:
+				_, err = tx.Exec(ctx, insertIgnoredDeathQuery, ignoredDeathArgs(item)...)
+			case item.msg.Kind() == "BIRTH", item.msg.Kind() == "DEATH":
+				_, err = tx.Exec(ctx, updateSparkplugStateQuery, sparkplugStateArgs(item)...)
+			case item.msg.Kind() == "STATE":
+				_, err = tx.Exec(ctx, updateHostStateQuery, hostStateArgs(item)...)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// writeDataCopyRow appends the data table row of a message in the column order of copyDataQuery.
+func writeDataCopyRow(buffer *bytes.Buffer, item ingestItem) {
+	msg := item.msg
+	payload := msg.Payload
+	writeCopyRow(buffer,
+		pgText(msg.Kind()),
+		pgTimestamp(item.receivedAt),
+		pgText(msg.GroupId),
+		pgText(msg.EdgeNodeId),
+		pgText(msg.DeviceId),
+		optMillis(payload.Timestamp),
+		optUint(payload.Seq),
+		optText(payload.Uuid),
+		optBytea(rawPayloadBody(item.body)),
+		metricsLiteral(payload.Metrics),
+	)
+}
+
+// ignoredDeathArgs returns the arguments of insertIgnoredDeathQuery for an ignored NDEATH.
+func ignoredDeathArgs(item ingestItem) []interface{} {
+	msg := item.msg
+	var bdSeq, expectedBdSeq *int64
+	if s := bdSeqOf(msg.Payload); s != nil {
+		v := int64(*s)
+		bdSeq = &v
+	}
+	if item.expectedBdSeq != nil {
+		v := int64(*item.expectedBdSeq)
+		expectedBdSeq = &v
+	}
+	return []interface{}{
+		msg.GroupId,
+		msg.EdgeNodeId,
+		msg.DeviceId,
+		payloadTime(msg.Payload),
+		bdSeq,
+		expectedBdSeq,
+		item.receivedAt,
+	}
+}
+
+// sparkplugStateArgs returns the arguments of updateSparkplugStateQuery for a message.
+func sparkplugStateArgs(item ingestItem) []interface{} {
+	msg := item.msg
+	return []interface{}{
+		msg.GroupId,
+		msg.Kind(),
+		msg.EdgeNodeId,
+		msg.DeviceId,
+		payloadTime(msg.Payload),
+		metricsLiteral(msg.Payload.Metrics),
+		item.receivedAt,
+	}
+}
+
+// payloadTime returns the timestamp of a payload, nil if it has none.
+func payloadTime(payload *sparkplug_b.Payload) *time.Time {
+	if payload.Timestamp == nil {
+		return nil
+	}
+	t := time.UnixMilli(int64(*payload.Timestamp)).UTC()
+	return &t
+}
+
+// hostStateArgs returns the arguments of updateHostStateQuery for a STATE message.
+func hostStateArgs(item ingestItem) []interface{} {
+	state := item.msg.State
+	return []interface{}{
+		item.msg.HostId,
+		state.Online,
+		time.UnixMilli(state.Timestamp).UTC(),
+		item.receivedAt,
+	}
+}
 
-	query := buffer.String()
-	_, err = db.Exec(query)
+func storeSequenceEventToDB(msg *SparkplugMessage, event *sequenceEvent, receivedAt time.Time) error {
+	query := `
+		INSERT INTO sequence_event
+			(group_id, edge_node_id, device_id, message_type, event, expected_seq, seq, rebirth_requested, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	var expectedSeq, seq *int64
+	if event.ExpectedSeq != nil {
+		s := int64(*event.ExpectedSeq)
+		expectedSeq = &s
+	}
+	if event.Seq != nil {
+		s := int64(*event.Seq)
+		seq = &s
+	}
+	_, err := db.Exec(query, msg.GroupId, msg.EdgeNodeId, msg.DeviceId, msg.MessageType,
+		event.Event, expectedSeq, seq, event.Rebirth, receivedAt)
+	return err
+}
+
+// storeStaleEventToDB records a STALE or ACTIVE transition in the session history.
+func storeStaleEventToDB(event *staleEvent) error {
+	query := `
+		INSERT INTO session_history
+			(group_id, edge_node_id, device_id, event, received_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := db.Exec(query, event.GroupId, event.EdgeNodeId, event.DeviceId, event.Event, event.DetectedAt)
 	return err
 }
 
-func loadSparkplugSqlTemplateFromFile(filename string) error {
-	// load template from file
-	tpl, err := template.New(filename).ParseFiles(filename)
+// TemplateDefinition is a template definition of the last NBIRTH of an edge node.
+type TemplateDefinition struct {
+	GroupId    string
+	EdgeNodeId string
+	Name       string
+	Template   Template
+}
+
+// getTemplateDefinitions returns the template definitions of the last NBIRTH of every edge node.
+func getTemplateDefinitions() ([]TemplateDefinition, error) {
+	query := `
+		SELECT b.group_id, b.edge_node_id, m.name, m.value_template
+		FROM birth AS b
+			CROSS JOIN LATERAL unnest(b.metrics) AS m
+		WHERE b.device_id=''
+		AND m.name IS NOT NULL
+		AND (m.value_template->>'isDefinition')::boolean
+	`
+	rows, err := db.Query(query)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sqlTemplate = tpl
-	return nil
+	defer rows.Close()
+
+	var definitions []TemplateDefinition
+	for rows.Next() {
+		var definition TemplateDefinition
+		var template []byte
+		if err := rows.Scan(&definition.GroupId, &definition.EdgeNodeId, &definition.Name, &template); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(template, &definition.Template); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, rows.Err()
 }
 
-type NodeListEntry struct {
+// getBirthBdSeqs returns the bdSeq of the last NBIRTH of every edge node, keyed by nodeKey.
+func getBirthBdSeqs() (map[string]uint64, error) {
+	query := `
+		SELECT b.group_id, b.edge_node_id, COALESCE(m.value_uint64, m.value_long, m.value_int)::text
+		FROM birth AS b
+			CROSS JOIN LATERAL unnest(b.metrics) AS m
+		WHERE b.device_id = ''
+		AND m.name = 'bdSeq'
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bdSeqs := make(map[string]uint64)
+	for rows.Next() {
+		var groupId, edgeNodeId string
+		var bdSeq *string
+		if err := rows.Scan(&groupId, &edgeNodeId, &bdSeq); err != nil {
+			return nil, err
+		}
+		if bdSeq == nil {
+			continue
+		}
+		if v, err := strconv.ParseUint(*bdSeq, 10, 64); err == nil {
+			bdSeqs[nodeKey(groupId, edgeNodeId)] = v
+		}
+	}
+	return bdSeqs, rows.Err()
+}
+
+// getLastSeqs returns the seq of the last message of every edge node that is
+// online, i.e. whose last NBIRTH was not followed by an NDEATH, keyed by nodeKey.
+func getLastSeqs() (map[string]uint64, error) {
+	query := `
+		SELECT b.group_id, b.edge_node_id, s.seq
+		FROM birth AS b
+			CROSS JOIN LATERAL (
+				SELECT d.seq
+				FROM data AS d
+				WHERE d.group_id=b.group_id
+				AND d.edge_node_id=b.edge_node_id
+				AND d.received_at >= b.received_at
+				AND d.message_type IN ('BIRTH', 'DATA', 'DEATH')
+				AND d.seq IS NOT NULL
+				ORDER BY d.received_at DESC
+				LIMIT 1
+			) AS s
+		WHERE b.device_id = ''
+		AND NOT EXISTS (
+			SELECT 1 FROM death AS x
+			WHERE x.group_id=b.group_id
+			AND x.edge_node_id=b.edge_node_id
+			AND x.device_id=''
+			AND x.received_at > b.received_at
+		)
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seqs := make(map[string]uint64)
+	for rows.Next() {
+		var groupId, edgeNodeId string
+		var seq int64
+		if err := rows.Scan(&groupId, &edgeNodeId, &seq); err != nil {
+			return nil, err
+		}
+		seqs[nodeKey(groupId, edgeNodeId)] = uint64(seq)
+	}
+	return seqs, rows.Err()
+}
+
+type MetricAlias struct {
+	GroupId    string
+	EdgeNodeId string
+	DeviceId   string
+	Name       string
+	Alias      uint64
+}
+
+// getMetricAliases returns the alias of every metric of the last birth of every
+// node and device. metrics_info is not used, as it keeps aliases that later
+// births dropped or reassigned.
+func getMetricAliases() ([]MetricAlias, error) {
+	query := `
+		SELECT b.group_id, b.edge_node_id, b.device_id, m.name, m.alias
+		FROM birth AS b
+			CROSS JOIN LATERAL unnest(b.metrics) AS m
+		WHERE m.name IS NOT NULL
+		AND m.alias IS NOT NULL
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []MetricAlias
+	for rows.Next() {
+		var alias MetricAlias
+		if err := rows.Scan(&alias.GroupId, &alias.EdgeNodeId, &alias.DeviceId, &alias.Name, &alias.Alias); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+type MetricDataType struct {
 	GroupId    string
 	EdgeNodeId string
 	DeviceId   string
-	IsOnline   bool
+	Name       string
+	DataType   uint32
+}
+
+// getMetricDataTypes returns the datatype of every metric of the last birth of every node and device.
+func getMetricDataTypes() ([]MetricDataType, error) {
+	query := `
+		SELECT b.group_id, b.edge_node_id, b.device_id, m.name, m.datatype
+		FROM birth AS b
+			CROSS JOIN LATERAL unnest(b.metrics) AS m
+		WHERE m.name IS NOT NULL
+		AND m.datatype IS NOT NULL
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dataTypes []MetricDataType
+	for rows.Next() {
+		var dataType MetricDataType
+		if err := rows.Scan(&dataType.GroupId, &dataType.EdgeNodeId, &dataType.DeviceId, &dataType.Name, &dataType.DataType); err != nil {
+			return nil, err
+		}
+		dataTypes = append(dataTypes, dataType)
+	}
+	return dataTypes, rows.Err()
+}
+
+// States of a node or device in the node list.
+const (
+	nodeStateOnline  = "online"
+	nodeStateOffline = "offline"
+	nodeStateUnknown = "unknown"
+	nodeStateStale   = "stale"
+)
+
+type NodeListEntry struct {
+	GroupId    string `json:"groupId"`
+	EdgeNodeId string `json:"edgeNodeId"`
+	DeviceId   string `json:"deviceId"`
+	State      string `json:"state"`
+	IsOnline   bool   `json:"isOnline"`
+}
+
+// nodeState returns the state of a node or device from the times its last birth
+// and death were received. A device is offline while its edge node is, and its
+// state is unknown after a newer NBIRTH until its own DBIRTH arrives. An online
+// node or device is stale if it has been silent for too long, see isStale.
+func nodeState(deviceId string, birth time.Time, death *time.Time, nodeBirth *time.Time, nodeDeath *time.Time, stale bool) string {
+	if deviceId != "" {
+		if nodeBirth == nil || (nodeDeath != nil && !nodeDeath.Before(*nodeBirth)) {
+			return nodeStateOffline
+		}
+		if nodeBirth.After(birth) {
+			return nodeStateUnknown
+		}
+	}
+	if death != nil && !death.Before(birth) {
+		return nodeStateOffline
+	}
+	if stale {
+		return nodeStateStale
+	}
+	return nodeStateOnline
 }
 
 func getNodes() ([]NodeListEntry, error) {
@@ -66,162 +431,504 @@ func getNodes() ([]NodeListEntry, error) {
             b.group_id,
             b.edge_node_id,
             b.device_id,
-            b.timestamp as birth_time,
-            d.received_at as death_time
+            b.received_at as birth_time,
+            d.received_at as death_time,
+            nb.received_at as node_birth_time,
+            nd.received_at as node_death_time
         FROM birth AS b
         LEFT JOIN public.death AS d
            ON
            d.edge_node_id=b.edge_node_id AND
            d.group_id=b.group_id AND
            d.device_id=b.device_id
-        ORDER BY device_id, edge_node_id;
+        LEFT JOIN birth AS nb
+           ON
+           nb.edge_node_id=b.edge_node_id AND
+           nb.group_id=b.group_id AND
+           nb.device_id=''
+        LEFT JOIN public.death AS nd
+           ON
+           nd.edge_node_id=b.edge_node_id AND
+           nd.group_id=b.group_id AND
+           nd.device_id=''
+        ORDER BY b.device_id, b.edge_node_id;
 	`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var nodes []NodeListEntry
 	for rows.Next() {
 		var node NodeListEntry
-		var lastBirth pgtype.Timestamp
-		var lastDeath *pgtype.Timestamp
-		if err := rows.Scan(&node.GroupId, &node.EdgeNodeId, &node.DeviceId, &lastBirth, &lastDeath); err != nil {
+		var lastBirth time.Time
+		var lastDeath, nodeBirth, nodeDeath *time.Time
+		if err := rows.Scan(&node.GroupId, &node.EdgeNodeId, &node.DeviceId, &lastBirth, &lastDeath, &nodeBirth, &nodeDeath); err != nil {
 			return nil, err
 		}
-		node.IsOnline = false
-		if lastDeath == nil || lastDeath.Time.Before(lastBirth.Time) {
-			node.IsOnline = true
-		}
+		node.State = nodeState(node.DeviceId, lastBirth, lastDeath, nodeBirth, nodeDeath,
+			isStale(node.GroupId, node.EdgeNodeId, node.DeviceId))
+		node.IsOnline = node.State == nodeStateOnline
 		nodes = append(nodes, node)
 	}
-	return nodes, nil
+	return nodes, rows.Err()
+}
+
+type HostListEntry struct {
+	HostId     string    `json:"hostId"`
+	IsOnline   bool      `json:"isOnline"`
+	Timestamp  time.Time `json:"timestamp"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+func getHosts() ([]HostListEntry, error) {
+	query := `
+		SELECT host_id, online, timestamp, received_at
+		FROM host_state
+		ORDER BY host_id;
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hosts []HostListEntry
+	for rows.Next() {
+		var host HostListEntry
+		if err := rows.Scan(&host.HostId, &host.IsOnline, &host.Timestamp, &host.ReceivedAt); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
 }
 
 type PropertyValue struct {
-	Type         int32
-	IsNull       bool
-	IntValue     *int32
-	LongValue    *int64
-	FloatValue   *float32
-	DoubleValue  *float64
-	BooleanValue *bool
-	StringValue  *string
+	Type         int32    `json:"type"`
+	IsNull       bool     `json:"isNull"`
+	IntValue     *int32   `json:"intValue,omitempty"`
+	LongValue    *int64   `json:"longValue,omitempty"`
+	Uint64Value  *uint64  `json:"uint64Value,omitempty"`
+	FloatValue   *float32 `json:"floatValue,omitempty"`
+	DoubleValue  *float64 `json:"doubleValue,omitempty"`
+	BooleanValue *bool    `json:"booleanValue,omitempty"`
+	StringValue  *string  `json:"stringValue,omitempty"`
+	// PropertySet and PropertySetList values
+	PropertySetValue  *PropertySet  `json:"propertySetValue,omitempty"`
+	PropertySetsValue []PropertySet `json:"propertySetsValue,omitempty"`
 }
 
+// FormatValue returns a scalar property value as text, "" if it has none.
+func (pv PropertyValue) FormatValue() string {
+	switch {
+	case pv.StringValue != nil:
+		return *pv.StringValue
+	case pv.BooleanValue != nil:
+		return strconv.FormatBool(*pv.BooleanValue)
+	case pv.IntValue != nil:
+		return strconv.FormatInt(int64(*pv.IntValue), 10)
+	case pv.LongValue != nil && pv.Type == 13:
+		return time.UnixMilli(*pv.LongValue).UTC().Format(time.RFC3339Nano)
+	case pv.LongValue != nil:
+		return strconv.FormatInt(*pv.LongValue, 10)
+	case pv.Uint64Value != nil:
+		return strconv.FormatUint(*pv.Uint64Value, 10)
+	case pv.DoubleValue != nil:
+		return strconv.FormatFloat(*pv.DoubleValue, 'g', -1, 64)
+	case pv.FloatValue != nil:
+		return strconv.FormatFloat(float64(*pv.FloatValue), 'g', -1, 32)
+	}
+	return ""
+}
+
+// PropertySet holds the properties of a metric, Values[i] being the value of Keys[i].
 type PropertySet struct {
-	keys   []string
-	values []PropertyValue
+	Keys   []string        `json:"keys"`
+	Values []PropertyValue `json:"values"`
 }
 
 type MetaData struct {
-	IsMultiPart bool
-	ContentType string
-	Size        int64
-	Seq         int64
-	FileName    string
-	FileType    string
-	Md5         string
-	Description string
+	IsMultiPart bool   `json:"isMultiPart"`
+	ContentType string `json:"contentType"`
+	Size        uint64 `json:"size"`
+	Seq         uint64 `json:"seq"`
+	FileName    string `json:"fileName"`
+	FileType    string `json:"fileType"`
+	Md5         string `json:"md5"`
+	Description string `json:"description"`
+}
+
+// DataSet is the table of a DataSet metric as stored in value_dataset.
+// Types holds the datatype of every column, Rows the cells row by row.
+type DataSet struct {
+	Columns []string        `json:"columns"`
+	Types   []uint32        `json:"types"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Template is a template definition or instance as stored in value_template.
+type Template struct {
+	Version      string              `json:"version,omitempty"`
+	TemplateRef  string              `json:"templateRef,omitempty"`
+	IsDefinition bool                `json:"isDefinition"`
+	Parameters   []TemplateParameter `json:"parameters"`
+	Members      []TemplateMember    `json:"members"`
+}
+
+type TemplateParameter struct {
+	Name  string      `json:"name"`
+	Type  uint32      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type TemplateMember struct {
+	Name     string `json:"name"`
+	DataType uint32 `json:"dataType"`
 }
 
 type Metric struct {
-	Name         string
-	Alias        int64
-	Timestamp    time.Time
-	DataType     int32
-	IsHistorical bool
-	IsTransient  bool
-	IsNull       bool
-	Metadata     *MetaData
-	Properties   *PropertySet
-	ValueString  *string
-	ValueBool    *bool
-	ValueInt     *int32
-	ValueUint64  *uint64
-	ValueDouble  *float64
-	ValueFloat   *float32
+	Name         string        `json:"name"`
+	Alias        *int64        `json:"alias,omitempty"`
+	Timestamp    time.Time     `json:"timestamp"`
+	DataType     int32         `json:"dataType"`
+	IsHistorical bool          `json:"isHistorical"`
+	IsTransient  bool          `json:"isTransient"`
+	IsNull       bool          `json:"isNull"`
+	Metadata     *MetaData     `json:"metadata,omitempty"`
+	Properties   *PropertySet  `json:"properties,omitempty"`
+	ValueString  *string       `json:"valueString,omitempty"`
+	ValueBool    *bool         `json:"valueBool,omitempty"`
+	ValueInt     *int32        `json:"valueInt,omitempty"`
+	ValueLong    *int64        `json:"valueLong,omitempty"`
+	ValueUint64  *uint64       `json:"valueUint64,omitempty"`
+	ValueDouble  *float64      `json:"valueDouble,omitempty"`
+	ValueFloat   *float32      `json:"valueFloat,omitempty"`
+	DataSet      *DataSet      `json:"dataSet,omitempty"`
+	Template     *Template     `json:"template,omitempty"`
+	Array        []interface{} `json:"array,omitempty"`
 }
 
-func (m *Metric) Scan(src interface{}) error {
-	source, ok := src.([]uint8)
-	if !ok {
-		return fmt.Errorf("type assertion to string failed")
-	}
-	sourceStr := string(source)
-	sourceStr = strings.Trim(sourceStr, "()")
-	parts := strings.Split(sourceStr, ",")
-	m.Name = strings.Trim(parts[0], "\"")
-	var err error
-	if err == nil && parts[1] != "" {
-		_, err = fmt.Sscanf(parts[1], "%d", &m.Alias)
+// MetricValue is a metric together with the time its message was received.
+type MetricValue struct {
+	Metric
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// FormatValue returns the value of the metric as text, "" if it has none.
+func (m Metric) FormatValue() string {
+	switch {
+	case m.Array != nil:
+		data, _ := json.Marshal(m.Array)
+		return string(data)
+	case m.ValueString != nil:
+		return *m.ValueString
+	case m.ValueBool != nil:
+		return strconv.FormatBool(*m.ValueBool)
+	case m.ValueInt != nil:
+		return strconv.FormatInt(int64(*m.ValueInt), 10)
+	case m.ValueLong != nil && m.DataType == 13:
+		return time.UnixMilli(*m.ValueLong).UTC().Format(time.RFC3339Nano)
+	case m.ValueLong != nil:
+		return strconv.FormatInt(*m.ValueLong, 10)
+	case m.ValueUint64 != nil:
+		return strconv.FormatUint(*m.ValueUint64, 10)
+	case m.ValueDouble != nil:
+		return strconv.FormatFloat(*m.ValueDouble, 'g', -1, 64)
+	case m.ValueFloat != nil:
+		return strconv.FormatFloat(float64(*m.ValueFloat), 'g', -1, 32)
+	}
+	return ""
+}
+
+// metricRow is a metric_type as rendered by to_jsonb. Reading metrics through
+// their JSON projection leaves the quoting of strings, NULLs and the nested
+// composites to the server instead of parsing the text representation of rows.
+type metricRow struct {
+	Name         *string          `json:"name"`
+	Alias        *int64           `json:"alias"`
+	Timestamp    *time.Time       `json:"timestamp"`
+	DataType     *int32           `json:"datatype"`
+	IsHistorical *bool            `json:"is_historical"`
+	IsTransient  *bool            `json:"is_transient"`
+	IsNull       *bool            `json:"is_null"`
+	Metadata     *metadataRow     `json:"metadata"`
+	Properties   *propertySetRow  `json:"properties"`
+	ValueString  *string          `json:"value_string"`
+	ValueBool    *bool            `json:"value_bool"`
+	ValueInt     *int32           `json:"value_int"`
+	ValueUint64  *uint64          `json:"value_uint64"`
+	ValueDouble  *jsonFloat       `json:"value_double"`
+	ValueFloat   *jsonFloat       `json:"value_float"`
+	ValueDataSet *json.RawMessage `json:"value_dataset"`
+	ValueTmpl    *json.RawMessage `json:"value_template"`
+	ValueArray   *json.RawMessage `json:"value_array"`
+	ValueLong    *int64           `json:"value_long"`
+}
+
+type metadataRow struct {
+	IsMultiPart *bool   `json:"is_multi_part"`
+	ContentType *string `json:"content_type"`
+	Size        *uint64 `json:"size"`
+	Seq         *uint64 `json:"seq"`
+	FileName    *string `json:"file_name"`
+	FileType    *string `json:"file_type"`
+	Md5         *string `json:"md5"`
+	Description *string `json:"description"`
+}
 
+type propertySetRow struct {
+	Keys   []*string           `json:"keys"`
+	Values []*propertyValueRow `json:"values"`
+}
+
+type propertyValueRow struct {
+	Type              *int32            `json:"type"`
+	IsNull            *bool             `json:"is_null"`
+	IntValue          *int32            `json:"int_value"`
+	LongValue         *int64            `json:"long_value"`
+	FloatValue        *jsonFloat        `json:"float_value"`
+	DoubleValue       *jsonFloat        `json:"double_value"`
+	BooleanValue      *bool             `json:"boolean_value"`
+	StringValue       *string           `json:"string_value"`
+	PropertySetValue  *propertySetRow   `json:"propertyset_value"`
+	PropertySetsValue []*propertySetRow `json:"propertysets_value"`
+	Uint64Value       *uint64           `json:"uint64_value"`
+}
+
+// jsonFloat is a DOUBLE PRECISION or REAL rendered by to_jsonb, which writes
+// NaN and the infinities as strings.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	default:
+		return json.Marshal(v)
 	}
-	if err == nil && parts[2] != "" {
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		switch s {
+		case "NaN":
+			*f = jsonFloat(math.NaN())
+		case "Infinity":
+			*f = jsonFloat(math.Inf(1))
+		case "-Infinity":
+			*f = jsonFloat(math.Inf(-1))
+		default:
+			return fmt.Errorf("invalid float %q", s)
+		}
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func (f *jsonFloat) float64() *float64 {
+	if f == nil {
+		return nil
+	}
+	v := float64(*f)
+	return &v
+}
+
+func (f *jsonFloat) float32() *float32 {
+	if f == nil {
+		return nil
+	}
+	v := float32(*f)
+	return &v
+}
 
-		m.Timestamp, err = time.Parse("\"2006-01-02 15:04:05.000-07\"", parts[2])
+func isJSONNull(raw *json.RawMessage) bool {
+	return raw == nil || string(*raw) == "null"
+}
+
+// decodeJSONNumbers decodes JSON keeping numbers as json.Number, so 64-bit
+// integers are not rounded.
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// Scan reads a metric_type from its JSON projection, to_jsonb(m).
+func (m *Metric) Scan(src interface{}) error {
+	var row metricRow
+	switch source := src.(type) {
+	case []uint8:
+		if err := json.Unmarshal(source, &row); err != nil {
+			return err
+		}
+	case string:
+		if err := json.Unmarshal([]byte(source), &row); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot scan %T into a metric", src)
 	}
+	return row.metric(m)
+}
 
-	if err == nil && parts[3] != "" {
-		_, err = fmt.Sscanf(parts[3], "%d", &m.DataType)
+// parseMetrics reads a metric_type[] from its JSON projection, to_jsonb(metrics).
+func parseMetrics(data []byte) ([]Metric, error) {
+	if data == nil {
+		return nil, nil
 	}
-	if err == nil && parts[4] != "" {
-		_, err = fmt.Sscanf(parts[4], "%t", &m.IsHistorical)
+	var rows []*metricRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
 	}
+	metrics := make([]Metric, 0, len(rows))
+	for _, row := range rows {
+		var m Metric
+		if row != nil {
+			if err := row.metric(&m); err != nil {
+				return nil, err
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
 
-	if err == nil && parts[5] != "" {
-		_, err = fmt.Sscanf(parts[5], "%t", &m.IsTransient)
+func (r *metricRow) metric(m *Metric) error {
+	*m = Metric{
+		Alias:       r.Alias,
+		ValueString: r.ValueString,
+		ValueBool:   r.ValueBool,
+		ValueInt:    r.ValueInt,
+		ValueLong:   r.ValueLong,
+		ValueUint64: r.ValueUint64,
+		ValueDouble: r.ValueDouble.float64(),
+		ValueFloat:  r.ValueFloat.float32(),
+		Metadata:    r.Metadata.metaData(),
+		Properties:  r.Properties.propertySet(),
+	}
+	if r.Name != nil {
+		m.Name = *r.Name
 	}
-	if err == nil && parts[6] != "" {
-		_, err = fmt.Sscanf(parts[6], "%t", &m.IsNull)
+	if r.Timestamp != nil {
+		m.Timestamp = *r.Timestamp
 	}
-	if err == nil && parts[9] != "" {
-		m.ValueString = &parts[9]
+	if r.DataType != nil {
+		m.DataType = *r.DataType
 	}
-	if err == nil && parts[10] != "" {
-		var boolVal bool
-		_, err = fmt.Sscanf(parts[10], "%t", &boolVal)
-		m.ValueBool = &boolVal
+	m.IsHistorical = isTrue(r.IsHistorical)
+	m.IsTransient = isTrue(r.IsTransient)
+	m.IsNull = isTrue(r.IsNull)
+
+	if !isJSONNull(r.ValueDataSet) {
+		m.DataSet = &DataSet{}
+		if err := decodeJSONNumbers(*r.ValueDataSet, m.DataSet); err != nil {
+			return err
+		}
+	}
+	if !isJSONNull(r.ValueTmpl) {
+		m.Template = &Template{}
+		if err := json.Unmarshal(*r.ValueTmpl, m.Template); err != nil {
+			return err
+		}
+	}
+	if !isJSONNull(r.ValueArray) {
+		if err := decodeJSONNumbers(*r.ValueArray, &m.Array); err != nil {
+			return err
+		}
 	}
-	if err == nil && parts[11] != "" {
-		var intVal int32
-		_, err = fmt.Sscanf(parts[11], "%d", &intVal)
-		m.ValueInt = &intVal
+	return nil
+}
+
+func (r *metadataRow) metaData() *MetaData {
+	if r == nil {
+		return nil
 	}
-	if err == nil && parts[12] != "" {
-		var uint64Val uint64
-		_, err = fmt.Sscanf(parts[12], "%d", &uint64Val)
-		m.ValueUint64 = &uint64Val
+	md := &MetaData{IsMultiPart: isTrue(r.IsMultiPart)}
+	if r.Size != nil {
+		md.Size = *r.Size
 	}
-	if err == nil && parts[13] != "" {
-		var doubleVal float64
-		_, err = fmt.Sscanf(parts[13], "%F", &doubleVal)
-		m.ValueDouble = &doubleVal
+	if r.Seq != nil {
+		md.Seq = *r.Seq
 	}
-	if err == nil && parts[14] != "" {
-		var floatVal float32
-		_, err = fmt.Sscanf(parts[14], "%f", &floatVal)
-		m.ValueFloat = &floatVal
+	for _, field := range []struct {
+		from *string
+		to   *string
+	}{
+		{r.ContentType, &md.ContentType},
+		{r.FileName, &md.FileName},
+		{r.FileType, &md.FileType},
+		{r.Md5, &md.Md5},
+		{r.Description, &md.Description},
+	} {
+		if field.from != nil {
+			*field.to = *field.from
+		}
 	}
+	return md
+}
 
-	return err
+func (r *propertySetRow) propertySet() *PropertySet {
+	if r == nil {
+		return nil
+	}
+	ps := &PropertySet{}
+	for i, key := range r.Keys {
+		if key == nil || i >= len(r.Values) || r.Values[i] == nil {
+			continue
+		}
+		v := r.Values[i]
+		pv := PropertyValue{
+			IsNull:       isTrue(v.IsNull),
+			IntValue:     v.IntValue,
+			LongValue:    v.LongValue,
+			Uint64Value:  v.Uint64Value,
+			FloatValue:   v.FloatValue.float32(),
+			DoubleValue:  v.DoubleValue.float64(),
+			BooleanValue: v.BooleanValue,
+			StringValue:  v.StringValue,
+		}
+		if v.Type != nil {
+			pv.Type = *v.Type
+		}
+		pv.PropertySetValue = v.PropertySetValue.propertySet()
+		for _, nested := range v.PropertySetsValue {
+			if nested != nil {
+				pv.PropertySetsValue = append(pv.PropertySetsValue, *nested.propertySet())
+			}
+		}
+		ps.Keys = append(ps.Keys, *key)
+		ps.Values = append(ps.Values, pv)
+	}
+	return ps
 }
 
 type NodeInfo struct {
-	GroupId    string            `db:"group_id"`
-	EdgeNodeId string            `db:"node_id"`
-	DeviceId   string            `db:"device_id"`
-	LastBirth  pgtype.Timestamp  `db:"last_birth"`
-	LastDeath  *pgtype.Timestamp `db:"last_death"` // nullable
-	Metrics    []Metric          `db:"metrics"`
+	GroupId    string     `db:"group_id" json:"groupId"`
+	EdgeNodeId string     `db:"node_id" json:"edgeNodeId"`
+	DeviceId   string     `db:"device_id" json:"deviceId"`
+	LastBirth  time.Time  `db:"last_birth" json:"lastBirth"` // receive time if the birth has no timestamp
+	LastDeath  *time.Time `db:"last_death" json:"lastDeath"` // nullable
+	Metrics    []Metric   `db:"metrics" json:"metrics"`
 }
 
 func getNodeInfo(groupId string, nodeId string, deviceId string) (*NodeInfo, error) {
 	query := `
 		SELECT
-		b.timestamp as last_birth,
+		COALESCE(b.timestamp, b.received_at) as last_birth,
 		d.received_at as last_death,
-		b.metrics as metrics
+		to_jsonb(b.metrics) as metrics
 		FROM birth AS b
 		    LEFT JOIN public.death AS d
 		        ON
@@ -233,11 +940,15 @@ func getNodeInfo(groupId string, nodeId string, deviceId string) (*NodeInfo, err
 		AND b.device_id=$3
 		ORDER BY b.group_id, b.device_id, b.edge_node_id
 		`
-	var lastBirth pgtype.Timestamp
-	var lastDeath *pgtype.Timestamp
+	var lastBirth time.Time
+	var lastDeath *time.Time
 	row := db.QueryRowx(query, groupId, nodeId, deviceId)
-	var metrics []Metric
-	err := row.Scan(&lastBirth, &lastDeath, pq.Array(&metrics))
+	var metricsJSON []byte
+	err := row.Scan(&lastBirth, &lastDeath, &metricsJSON)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := parseMetrics(metricsJSON)
 	if err != nil {
 		return nil, err
 	}
@@ -245,3 +956,294 @@ func getNodeInfo(groupId string, nodeId string, deviceId string) (*NodeInfo, err
 	return &nodeInfo, nil
 
 }
+
+// nodeExists reports whether a node or device has ever been born.
+func nodeExists(groupId string, nodeId string, deviceId string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM birth WHERE group_id=$1 AND edge_node_id=$2 AND device_id=$3)`,
+		groupId, nodeId, deviceId).Scan(&exists)
+	return exists, err
+}
+
+// getSessionHistory returns the transitions of a node or device in the range
+// [from, to), preceded by the last transition before from, if any.
+func getSessionHistory(groupId string, nodeId string, deviceId string, from time.Time, to time.Time) ([]SessionEvent, error) {
+	query := `
+		(
+			SELECT event, received_at
+			FROM session_history
+			WHERE group_id=$1 AND edge_node_id=$2 AND device_id=$3
+			AND received_at < $4
+			ORDER BY received_at DESC
+			LIMIT 1
+		)
+		UNION ALL
+		(
+			SELECT event, received_at
+			FROM session_history
+			WHERE group_id=$1 AND edge_node_id=$2 AND device_id=$3
+			AND received_at >= $4 AND received_at < $5
+		)
+		ORDER BY received_at
+	`
+	rows, err := db.Query(query, groupId, nodeId, deviceId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SessionEvent{}
+	for rows.Next() {
+		var event SessionEvent
+		if err := rows.Scan(&event.Event, &event.ReceivedAt); err != nil {
+			return nil, err
+		}
+		event.State = sessionStates[event.Event]
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// StoredMessage is a message of a node or device in the data table.
+type StoredMessage struct {
+	MessageType string     `json:"messageType"`
+	ReceivedAt  time.Time  `json:"receivedAt"`
+	Timestamp   *time.Time `json:"timestamp"`
+	Seq         *int64     `json:"seq"`
+	Uuid        *string    `json:"uuid,omitempty"`
+	BodySize    *int64     `json:"bodySize"` // stored size of the raw payload, nil if not stored
+}
+
+// getStoredMessages returns at most limit messages of a node or device received
+// in the range [from, to).
+func getStoredMessages(groupId string, nodeId string, deviceId string, from time.Time, to time.Time, limit int) ([]StoredMessage, error) {
+	query := `
+		SELECT message_type::text, received_at, timestamp, seq, uuid, octet_length(body)
+		FROM data
+		WHERE group_id=$1 AND edge_node_id=$2 AND device_id=$3
+		AND received_at >= $4 AND received_at < $5
+		ORDER BY received_at
+		LIMIT $6
+	`
+	rows, err := db.Query(query, groupId, nodeId, deviceId, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []StoredMessage{}
+	for rows.Next() {
+		var m StoredMessage
+		if err := rows.Scan(&m.MessageType, &m.ReceivedAt, &m.Timestamp, &m.Seq, &m.Uuid, &m.BodySize); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// getRawPayload returns the stored body of the message of a node or device
+// received at receivedAt, nil if it was stored without one. Returns
+// sql.ErrNoRows if there is no such message.
+func getRawPayload(groupId string, nodeId string, deviceId string, receivedAt time.Time) ([]byte, error) {
+	query := `
+		SELECT body
+		FROM data
+		WHERE group_id=$1 AND edge_node_id=$2 AND device_id=$3 AND received_at=$4
+		ORDER BY body IS NULL
+		LIMIT 1
+	`
+	var body []byte
+	err := db.QueryRow(query, groupId, nodeId, deviceId, receivedAt).Scan(&body)
+	return body, err
+}
+
+// getAllLatestMetrics returns the latest value of every metric received since
+// the last birth of every node and device that has not died since, keyed by
+// deviceKey. Devices born before the last birth of their edge node are left out.
+func getAllLatestMetrics() (map[string]map[string]MetricValue, error) {
+	query := `
+		SELECT DISTINCT ON (d.group_id, d.edge_node_id, d.device_id, m.name)
+			d.group_id,
+			d.edge_node_id,
+			d.device_id,
+			d.received_at,
+			to_jsonb(m)
+		FROM birth AS b
+			JOIN data AS d ON d.group_id=b.group_id
+				AND d.edge_node_id=b.edge_node_id
+				AND d.device_id=b.device_id
+				AND d.received_at >= b.received_at
+			CROSS JOIN LATERAL unnest(d.metrics) AS m
+		WHERE d.message_type IN ('BIRTH', 'DATA')
+		AND m.name IS NOT NULL
+		AND NOT COALESCE(m.is_historical, false)
+		AND NOT EXISTS (
+			SELECT 1 FROM death AS x
+			WHERE x.group_id=b.group_id
+			AND x.edge_node_id=b.edge_node_id
+			AND x.device_id IN (b.device_id, '')
+			AND x.received_at > b.received_at
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM birth AS nb
+			WHERE nb.group_id=b.group_id
+			AND nb.edge_node_id=b.edge_node_id
+			AND nb.device_id=''
+			AND b.device_id<>''
+			AND nb.received_at > b.received_at
+		)
+		ORDER BY d.group_id, d.edge_node_id, d.device_id, m.name, d.received_at DESC
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]map[string]MetricValue)
+	for rows.Next() {
+		var groupId, nodeId, deviceId string
+		var metric MetricValue
+		if err := rows.Scan(&groupId, &nodeId, &deviceId, &metric.ReceivedAt, &metric.Metric); err != nil {
+			return nil, err
+		}
+		key := deviceKey(groupId, nodeId, deviceId)
+		metrics, ok := values[key]
+		if !ok {
+			metrics = make(map[string]MetricValue)
+			values[key] = metrics
+		}
+		metrics[metric.Name] = metric
+	}
+	return values, rows.Err()
+}
+
+// metricValueExpr converts the value of a numeric or boolean metric m to DOUBLE PRECISION.
+const metricValueExpr = `COALESCE(
+			m.value_double,
+			CAST(m.value_float AS DOUBLE PRECISION),
+			CAST(m.value_int AS DOUBLE PRECISION),
+			CAST(m.value_long AS DOUBLE PRECISION),
+			CAST(m.value_uint64 AS DOUBLE PRECISION),
+			CASE WHEN m.value_bool THEN 1.0 WHEN NOT m.value_bool THEN 0.0 END
+		)`
+
+// historyAggregates maps the aggregations of the history API to SQL.
+var historyAggregates = map[string]string{
+	"avg":   "avg(" + metricValueExpr + ")",
+	"min":   "min(" + metricValueExpr + ")",
+	"max":   "max(" + metricValueExpr + ")",
+	"count": "CAST(count(" + metricValueExpr + ") AS DOUBLE PRECISION)",
+	"last":  "last(" + metricValueExpr + ", " + sampleTimeExpr + ")",
+}
+
+// sampleTimeExpr is the time a value of metric m of message d was measured,
+// which for historical metrics of store and forward can be long before the
+// message was received.
+const sampleTimeExpr = `COALESCE(m.timestamp, d.timestamp, d.received_at)`
+
+// historyReceiveSlack is how long before its measurement time a value may
+// have been received, as the clock of an edge node may be ahead of the one of
+// hostapp. Values are received after they were measured otherwise, so the
+// receive time, which the data table is partitioned by, bounds the scanned
+// chunks of a history query.
+const historyReceiveSlack = 24 * time.Hour
+
+// historyFills maps the gap filling modes of the history API to a function
+// wrapping the aggregate. An empty function fills gaps with NULL.
+var historyFills = map[string]string{
+	"null":        "",
+	"locf":        "locf",
+	"interpolate": "interpolate",
+}
+
+type HistoryQuery struct {
+	GroupId    string
+	EdgeNodeId string
+	DeviceId   string
+	Metric     string
+	From       time.Time
+	To         time.Time
+	Aggregate  string        // one of historyAggregates, "" for raw values
+	Bucket     time.Duration // width of the time buckets of an aggregation
+	Fill       string        // one of historyFills, "" for no gap filling
+	MaxPoints  int
+}
+
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value *float64  `json:"value"`
+}
+
+// getMetricHistory returns the values of a metric measured in [From, To),
+// either raw or aggregated into time buckets, with at most MaxPoints points,
+// and whether there were more. Values are placed at the time they were
+// measured, see sampleTimeExpr; the time they were received only limits the
+// chunks that are scanned, see historyReceiveSlack.
+func getMetricHistory(q HistoryQuery) ([]HistoryPoint, bool, error) {
+	query, args := metricHistoryQuery(q)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	points := []HistoryPoint{}
+	for rows.Next() {
+		var point HistoryPoint
+		if err := rows.Scan(&point.Time, &point.Value); err != nil {
+			return nil, false, err
+		}
+		points = append(points, point)
+	}
+	if len(points) > q.MaxPoints {
+		return points[:q.MaxPoints], true, rows.Err()
+	}
+	return points, false, rows.Err()
+}
+
+// metricHistoryQuery returns the query of getMetricHistory and its arguments,
+// the raw values or, with an aggregate, one row per bucket.
+func metricHistoryQuery(q HistoryQuery) (string, []interface{}) {
+	timeExpr := sampleTimeExpr
+	valueExpr := metricValueExpr
+	groupBy := ""
+	if q.Aggregate != "" {
+		valueExpr = historyAggregates[q.Aggregate]
+		timeExpr = "time_bucket($9::interval, " + sampleTimeExpr + ")"
+		if fill, ok := historyFills[q.Fill]; ok {
+			timeExpr = "time_bucket_gapfill($9::interval, " + sampleTimeExpr + ", $5, $6)"
+			if fill != "" {
+				valueExpr = fill + "(" + valueExpr + ")"
+			}
+		}
+		groupBy = "GROUP BY 1"
+	}
+
+	query := `
+		SELECT
+			` + timeExpr + ` AS time,
+			` + valueExpr + ` AS value
+		FROM data AS d
+			CROSS JOIN LATERAL unnest(d.metrics) AS m
+		WHERE d.group_id=$1
+		AND d.edge_node_id=$2
+		AND d.device_id=$3
+		AND d.message_type IN ('BIRTH', 'DATA')
+		AND m.name=$4
+		AND d.received_at >= $8
+		AND ` + sampleTimeExpr + ` >= $5
+		AND ` + sampleTimeExpr + ` < $6
+		` + groupBy + `
+		ORDER BY 1
+		LIMIT $7
+	`
+	// one more point than requested tells whether there are more
+	args := []interface{}{q.GroupId, q.EdgeNodeId, q.DeviceId, q.Metric, q.From, q.To, q.MaxPoints + 1,
+		q.From.Add(-historyReceiveSlack)}
+	if q.Aggregate != "" {
+		args = append(args, fmt.Sprintf("%d microseconds", q.Bucket.Microseconds()))
+	}
+	return query, args
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeState(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		t := t0.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+	tests := []struct {
+		name      string
+		deviceId  string
+		birth     time.Time
+		death     *time.Time
+		nodeBirth *time.Time
+		nodeDeath *time.Time
+		stale     bool
+		want      string
+	}{
+		{"node online", "", *at(1), nil, nil, nil, false, nodeStateOnline},
+		{"node died", "", *at(1), at(2), nil, nil, false, nodeStateOffline},
+		{"node reborn", "", *at(2), at(1), nil, nil, false, nodeStateOnline},
+		{"node death at the birth time", "", *at(1), at(1), nil, nil, false, nodeStateOffline},
+		{"node stale", "", *at(1), nil, nil, nil, true, nodeStateStale},
+		{"dead node is not stale", "", *at(1), at(2), nil, nil, true, nodeStateOffline},
+		{"device online", "d", *at(2), nil, at(1), nil, false, nodeStateOnline},
+		{"device of a dead node", "d", *at(2), nil, at(1), at(3), false, nodeStateOffline},
+		{"device of a reborn node", "d", *at(4), nil, at(3), at(2), false, nodeStateOnline},
+		{"device without node birth", "d", *at(2), nil, nil, nil, false, nodeStateOffline},
+		{"device before the node birth", "d", *at(2), nil, at(3), nil, false, nodeStateUnknown},
+		{"device died", "d", *at(2), at(3), at(1), nil, false, nodeStateOffline},
+		{"device stale", "d", *at(2), nil, at(1), nil, true, nodeStateStale},
+		{"unknown device is not stale", "d", *at(2), nil, at(3), nil, true, nodeStateUnknown},
+	}
+	for _, test := range tests {
+		got := nodeState(test.deviceId, test.birth, test.death, test.nodeBirth, test.nodeDeath, test.stale)
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	batchSize     int
+	flushInterval time.Duration
+	ingestWorkers int
+)
+
+// ingestItem is a decoded message waiting to be written to the database.
+type ingestItem struct {
+	msg        *SparkplugMessage
+	receivedAt time.Time
+	ack        func(error) // optional, called after the batch was written
+	body       []byte      // encoded payload stored in data.body, see rawPayloadBody
+
+	// ignoredDeath is set for an NDEATH of an earlier session of the edge node,
+	// expectedBdSeq is the bdSeq of the current session.
+	ignoredDeath  bool
+	expectedBdSeq *uint64
+}
+
+var ingestQueues []chan ingestItem
+var ingestWG sync.WaitGroup
+
+// startIngestion starts the workers that write decoded messages to the database in batches.
+func startIngestion() {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if ingestWorkers < 1 {
+		ingestWorkers = 1
+	}
+	log.Printf("Starting %d ingestion workers (batch size %d, flush interval %v).\n", ingestWorkers, batchSize, flushInterval)
+	ingestQueues = make([]chan ingestItem, ingestWorkers)
+	for i := range ingestQueues {
+		queue := make(chan ingestItem, batchSize)
+		ingestQueues[i] = queue
+		ingestWG.Add(1)
+		go runIngestWorker(queue)
+	}
+}
+
+// stopIngestion flushes all pending messages and stops the workers.
+func stopIngestion() {
+	for _, queue := range ingestQueues {
+		close(queue)
+	}
+	ingestWG.Wait()
+}
+
+// enqueueIngestItem hands a decoded message to the ingestion workers.
+// All messages of an edge node go to the same worker, so births, deaths and
+// data of a node are written in the order they were received.
+// Blocks while the queue of that worker is full.
+func enqueueIngestItem(item ingestItem) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(nodeKey(item.msg.GroupId, item.msg.EdgeNodeId)))
+	queue := ingestQueues[h.Sum32()%uint32(len(ingestQueues))]
+	queue <- item
+}
+
+// storeItems writes a batch with store and acknowledges its items. If the batch
+// fails, which rolls it back as a whole, its items are written one by one, so
+// a single bad message does not drop the messages of other nodes with it.
+func storeItems(batch []ingestItem, store func([]ingestItem) error) {
+	err := store(batch)
+	if err != nil && len(batch) > 1 {
+		log.Printf("Error saving batch of %d messages to DB, retrying them one by one: %v", len(batch), err)
+		for i := range batch {
+			storeItems(batch[i:i+1], store)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving %v of %v/%v/%v to DB: %v", batch[0].msg.MessageType,
+			batch[0].msg.GroupId, batch[0].msg.EdgeNodeId, batch[0].msg.DeviceId, err)
+	}
+	for _, item := range batch {
+		if item.ack != nil {
+			item.ack(err)
+		}
+	}
+}
+
+func runIngestWorker(queue <-chan ingestItem) {
+	defer ingestWG.Done()
+
+	batch := make([]ingestItem, 0, batchSize)
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		storeItems(batch, storeSparkplugBatchToDB)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= batchSize {
+				flush()
+			} else if timer == nil {
+				// the first message of a batch waits at most flushInterval
+				timer = time.NewTimer(flushInterval)
+				timeout = timer.C
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStoreItemsRetriesOneByOne(t *testing.T) {
+	acks := map[string]error{}
+	var batch []ingestItem
+	for _, node := range []string{"a", "bad", "c"} {
+		node := node
+		batch = append(batch, ingestItem{
+			msg: &SparkplugMessage{MessageType: "NDATA", GroupId: "g", EdgeNodeId: node},
+			ack: func(err error) { acks[node] = err },
+		})
+	}
+	errBadRow := errors.New("bad row")
+	var calls [][]string
+	store := func(items []ingestItem) error {
+		var nodes []string
+		for _, item := range items {
+			nodes = append(nodes, item.msg.EdgeNodeId)
+		}
+		calls = append(calls, nodes)
+		for _, item := range items {
+			if item.msg.EdgeNodeId == "bad" {
+				return errBadRow
+			}
+		}
+		return nil
+	}
+
+	storeItems(batch, store)
+	if len(calls) != 4 || len(calls[0]) != 3 {
+		t.Errorf("store calls: got %v, want the batch followed by its 3 items", calls)
+	}
+	if len(acks) != 3 || acks["a"] != nil || acks["c"] != nil || !errors.Is(acks["bad"], errBadRow) {
+		t.Errorf("acks: got %v", acks)
+	}
+
+	calls = nil
+	storeItems(batch[:1], store)
+	if len(calls) != 1 {
+		t.Errorf("store calls of a successful batch: got %v", calls)
+	}
+}
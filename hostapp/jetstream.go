@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	useJetStream   bool
+	jsStreamName   string
+	jsDurableName  string
+	jsStreamMaxAge time.Duration
+	jsMaxDeliver   int
+)
+
+var jsStop chan struct{}
+var jsWG sync.WaitGroup
+
+// subscribeJetStream binds a durable pull consumer to a stream over the Sparkplug
+// subjects, creating both if necessary. Messages stored while hostapp was not
+// running are delivered first. A message is acknowledged only after the batch
+// containing it has been committed to the database.
+func subscribeJetStream(nc *nats.Conn) (*nats.Subscription, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := js.StreamInfo(jsStreamName)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		log.Printf("Creating JetStream stream %v.\n", jsStreamName)
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     jsStreamName,
+			Subjects: streamSubjects(),
+			Storage:  nats.FileStorage,
+			MaxAge:   jsStreamMaxAge,
+		})
+	case err == nil && !slices.Equal(stream.Config.Subjects, streamSubjects()):
+		log.Printf("Updating the subjects of JetStream stream %v.\n", jsStreamName)
+		config := stream.Config
+		config.Subjects = streamSubjects()
+		_, err = js.UpdateStream(&config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	consumerConfig := &nats.ConsumerConfig{
+		Durable:       jsDurableName,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       flushInterval + 30*time.Second,
+		MaxAckPending: batchSize * ingestWorkers * 2,
+		MaxDeliver:    jsMaxDeliver,
+		DeliverPolicy: nats.DeliverAllPolicy,
+	}
+	// an existing consumer gets the current configuration, e.g. a changed -jsMaxDeliver
+	_, err = js.ConsumerInfo(jsStreamName, jsDurableName)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(jsStreamName, consumerConfig)
+	case err == nil:
+		_, err = js.UpdateConsumer(jsStreamName, consumerConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// bind to the existing consumer, so unsubscribing does not delete it
+	sub, err := js.PullSubscribe("", jsDurableName, nats.Bind(jsStreamName, jsDurableName))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Bound to durable consumer %v of stream %v.\n", jsDurableName, jsStreamName)
+
+	jsStop = make(chan struct{})
+	jsWG.Add(1)
+	go runJetStreamConsumer(sub)
+	return sub, nil
+}
+
+// streamSubjects are the subjects captured by the stream: the messages of edge
+// nodes and devices and STATE, but not the commands sent to them, which include
+// the rebirth requests and writes of hostapp itself.
+func streamSubjects() []string {
+	subjects := []string{"spBv1//0.STATE.*"}
+	for _, messageType := range []string{"NBIRTH", "NDATA", "NDEATH", "DBIRTH", "DDATA", "DDEATH"} {
+		subjects = append(subjects, "spBv1//0.*."+messageType+".>")
+	}
+	return subjects
+}
+
+// stopJetStream stops fetching new messages. Messages already handed to the
+// ingestion workers are acknowledged when their batch is written.
+func stopJetStream() {
+	if jsStop == nil {
+		return
+	}
+	close(jsStop)
+	jsWG.Wait()
+	jsStop = nil
+}
+
+func runJetStreamConsumer(sub *nats.Subscription) {
+	defer jsWG.Done()
+	for {
+		select {
+		case <-jsStop:
+			return
+		default:
+		}
+
+		msgs, err := sub.Fetch(batchSize, nats.MaxWait(time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			log.Printf("Error fetching from JetStream: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			receivedAt := time.Now()
+			redelivered := false
+			if meta, err := msg.Metadata(); err == nil {
+				receivedAt = meta.Timestamp
+				redelivered = meta.NumDelivered > 1
+			}
+			err = processSparkplugMessage(msg.Subject, msg.Data, receivedAt, redelivered, jetStreamAck(msg))
+			if err != nil {
+				log.Printf("Error during unmarshalling: %v", err)
+				// the message will never decode, don't redeliver it
+				_ = msg.Term()
+			}
+		}
+	}
+}
+
+// jetStreamAck returns the callback the ingestion workers call once the
+// message has been written (err == nil) or failed to be written. A message
+// that failed in its last delivery is terminated, so it is not redelivered.
+func jetStreamAck(msg *nats.Msg) func(error) {
+	return func(err error) {
+		switch {
+		case err == nil:
+			err = msg.Ack()
+		case isLastDelivery(msg):
+			log.Printf("Dropping %v after %d failed deliveries: %v", msg.Subject, jsMaxDeliver, err)
+			err = msg.Term()
+		default:
+			err = msg.NakWithDelay(time.Second)
+		}
+		if err != nil {
+			log.Printf("Error acknowledging %v: %v", msg.Subject, err)
+		}
+	}
+}
+
+// isLastDelivery reports whether the consumer will not deliver msg again.
+func isLastDelivery(msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+	return err == nil && jsMaxDeliver > 0 && meta.NumDelivered >= uint64(jsMaxDeliver)
+}
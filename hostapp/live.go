@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const liveKeepAliveInterval = 30 * time.Second
+
+// MetricUpdate is a metric value received in a BIRTH or DATA message,
+// streamed to the web UI as it arrives. 64-bit integers are sent as strings,
+// as JavaScript numbers cannot represent all of them.
+type MetricUpdate struct {
+	Name       string      `json:"name"`
+	Alias      *uint64     `json:"alias,omitempty,string"`
+	DataType   uint32      `json:"dataType"`
+	Value      interface{} `json:"value"`
+	IsNull     bool        `json:"isNull"`
+	Timestamp  *time.Time  `json:"timestamp,omitempty"`
+	ReceivedAt time.Time   `json:"receivedAt"`
+}
+
+// liveSubscribers holds the channels of all open event streams, keyed by deviceKey.
+var liveSubscribers = map[string]map[chan []MetricUpdate]struct{}{}
+var liveSubscribersMutex sync.Mutex
+
+// liveDone is closed on shutdown to end all open event streams.
+var liveDone = make(chan struct{})
+
+func subscribeLive(key string) chan []MetricUpdate {
+	updates := make(chan []MetricUpdate, 16)
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	subscribers, ok := liveSubscribers[key]
+	if !ok {
+		subscribers = make(map[chan []MetricUpdate]struct{})
+		liveSubscribers[key] = subscribers
+	}
+	subscribers[updates] = struct{}{}
+	return updates
+}
+
+func unsubscribeLive(key string, updates chan []MetricUpdate) {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	delete(liveSubscribers[key], updates)
+	if len(liveSubscribers[key]) == 0 {
+		delete(liveSubscribers, key)
+	}
+}
+
+// stopLiveUpdates ends all open event streams, so the web server can shut down.
+func stopLiveUpdates() {
+	close(liveDone)
+}
+
+// metricUpdates converts the metrics of a message to updates. Historical
+// metrics are not current values and are left out, like in the LKV cache.
+func metricUpdates(msg *SparkplugMessage, receivedAt time.Time) []MetricUpdate {
+	updates := make([]MetricUpdate, 0, len(msg.Payload.Metrics))
+	for _, metric := range msg.Payload.Metrics {
+		if metric.GetIsHistorical() {
+			continue
+		}
+		update := MetricUpdate{
+			Name:       metric.GetName(),
+			Alias:      metric.Alias,
+			DataType:   metric.GetDatatype(),
+			Value:      liveValue(jsonValue(metricValue(metric))),
+			IsNull:     metric.GetIsNull(),
+			Timestamp:  millisTime(metric.Timestamp),
+			ReceivedAt: receivedAt,
+		}
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+// jsonValue replaces the float values JSON cannot represent (NaN, ±Inf) by their name.
+func jsonValue(value interface{}) interface{} {
+	var f float64
+	switch v := value.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return value
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return value
+}
+
+// liveValue replaces the 64-bit integers of a metric value, including the
+// elements of arrays, the cells of DataSets and the template parameters, by
+// their decimal text.
+func liveValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case []interface{}:
+		elements := make([]interface{}, len(v))
+		for i, element := range v {
+			elements[i] = liveValue(element)
+		}
+		return elements
+	case *DataSet:
+		if v == nil {
+			return v
+		}
+		dataSet := *v
+		dataSet.Rows = make([][]interface{}, len(v.Rows))
+		for i, row := range v.Rows {
+			dataSet.Rows[i] = liveValue(row).([]interface{})
+		}
+		return &dataSet
+	case *Template:
+		if v == nil {
+			return v
+		}
+		template := *v
+		template.Parameters = make([]TemplateParameter, len(v.Parameters))
+		for i, p := range v.Parameters {
+			p.Value = liveValue(p.Value)
+			template.Parameters[i] = p
+		}
+		return &template
+	}
+	return value
+}
+
+// publishLive sends the metrics of a BIRTH or DATA message to the event streams
+// of its node or device. Slow subscribers miss updates rather than block ingestion.
+func publishLive(msg *SparkplugMessage, receivedAt time.Time) {
+	kind := msg.Kind()
+	if kind != "BIRTH" && kind != "DATA" {
+		return
+	}
+	key := deviceKey(msg.GroupId, msg.EdgeNodeId, msg.DeviceId)
+
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	subscribers := liveSubscribers[key]
+	if len(subscribers) == 0 {
+		return
+	}
+	updates := metricUpdates(msg, receivedAt)
+	if len(updates) == 0 {
+		return
+	}
+	for subscriber := range subscribers {
+		select {
+		case subscriber <- updates:
+		default:
+		}
+	}
+}
+
+// serveLiveUpdates streams the metric updates of a node or device as
+// Server-Sent Events. Every event "metrics" carries a JSON array of MetricUpdate.
+func serveLiveUpdates(c echo.Context) error {
+	key := deviceKey(c.Param("groupId"), c.Param("nodeId"), c.Param("deviceId"))
+	updates := subscribeLive(key)
+	defer unsubscribeLive(key, updates)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepAlive := time.NewTicker(liveKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-liveDone:
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case batch := <-updates:
+			data, err := json.Marshal(batch)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: metrics\ndata: %s\n\n", data); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+	}
+}
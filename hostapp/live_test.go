@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"hostapp/sparkplug_b"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMetricUpdates64BitIntegers(t *testing.T) {
+	const maxUint64 = "18446744073709551615"
+	uint64Array := make([]byte, 8)
+	for i := range uint64Array {
+		uint64Array[i] = 0xff
+	}
+	msg := &SparkplugMessage{Payload: &sparkplug_b.Payload{Metrics: []*sparkplug_b.Payload_Metric{
+		{Name: proto.String("u64"), Alias: proto.Uint64(1 << 60), Datatype: proto.Uint32(8),
+			Value: &sparkplug_b.Payload_Metric_LongValue{LongValue: 1<<64 - 1}},
+		{Name: proto.String("i64"), Datatype: proto.Uint32(4),
+			Value: &sparkplug_b.Payload_Metric_LongValue{LongValue: uint64(1<<63 + 1)}},
+		{Name: proto.String("u32"), Datatype: proto.Uint32(7),
+			Value: &sparkplug_b.Payload_Metric_LongValue{LongValue: 1<<32 - 1}},
+		{Name: proto.String("array"), Datatype: proto.Uint32(29),
+			Value: &sparkplug_b.Payload_Metric_BytesValue{BytesValue: uint64Array}},
+		{Name: proto.String("dataset"), Datatype: proto.Uint32(16),
+			Value: &sparkplug_b.Payload_Metric_DatasetValue{DatasetValue: &sparkplug_b.Payload_DataSet{
+				NumOfColumns: proto.Uint64(2), Columns: []string{"a", "b"}, Types: []uint32{8, 10},
+				Rows: []*sparkplug_b.Payload_DataSet_Row{{Elements: []*sparkplug_b.Payload_DataSet_DataSetValue{
+					{Value: &sparkplug_b.Payload_DataSet_DataSetValue_LongValue{LongValue: 1<<64 - 1}},
+					{Value: &sparkplug_b.Payload_DataSet_DataSetValue_DoubleValue{DoubleValue: 1.5}},
+				}}}}}},
+		{Name: proto.String("template"), Datatype: proto.Uint32(19),
+			Value: &sparkplug_b.Payload_Metric_TemplateValue{TemplateValue: &sparkplug_b.Payload_Template{
+				TemplateRef: proto.String("T"),
+				Parameters: []*sparkplug_b.Payload_Template_Parameter{{Name: proto.String("p"), Type: proto.Uint32(8),
+					Value: &sparkplug_b.Payload_Template_Parameter_LongValue{LongValue: 1<<64 - 1}}}}}},
+	}}}
+
+	data, err := json.Marshal(metricUpdates(msg, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"alias":"1152921504606846976"`,
+		`"value":"` + maxUint64 + `"`,
+		`"value":"-9223372036854775807"`,
+		`"value":4294967295`,
+		`"value":["` + maxUint64 + `"]`,
+		`"rows":[["` + maxUint64 + `",1.5]]`,
+		`"parameters":[{"name":"p","type":8,"value":"` + maxUint64 + `"}]`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s does not contain %s", data, want)
+		}
+	}
+}
+
+func TestMetricUpdatesSkipHistorical(t *testing.T) {
+	msg := &SparkplugMessage{Payload: &sparkplug_b.Payload{Metrics: []*sparkplug_b.Payload_Metric{
+		{Name: proto.String("m"), Datatype: proto.Uint32(10), IsHistorical: proto.Bool(true),
+			Value: &sparkplug_b.Payload_Metric_DoubleValue{DoubleValue: 1}},
+		{Name: proto.String("m"), Datatype: proto.Uint32(10),
+			Value: &sparkplug_b.Payload_Metric_DoubleValue{DoubleValue: 2}},
+	}}}
+	updates := metricUpdates(msg, time.Now())
+	if len(updates) != 1 || updates[0].Value != float64(2) {
+		t.Errorf("got %+v, want only the current value 2", updates)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lkvCache holds the last known value of every metric of every node and
+// device that is online, keyed by deviceKey and metric name.
+var lkvCache = map[string]map[string]MetricValue{}
+var lkvCacheMutex sync.RWMutex
+
+// metricFromPayload converts a received metric to the representation used for
+// metrics read from the database.
+func metricFromPayload(m *sparkplug_b.Payload_Metric) Metric {
+	metric := Metric{
+		Name:         m.GetName(),
+		DataType:     int32(m.GetDatatype()),
+		IsHistorical: m.GetIsHistorical(),
+		IsTransient:  m.GetIsTransient(),
+		IsNull:       m.GetIsNull(),
+	}
+	if m.Alias != nil {
+		alias := int64(*m.Alias)
+		metric.Alias = &alias
+	}
+	if t := millisTime(m.Timestamp); t != nil {
+		metric.Timestamp = *t
+	}
+	if md := m.Metadata; md != nil {
+		metric.Metadata = &MetaData{
+			IsMultiPart: md.GetIsMultiPart(),
+			ContentType: md.GetContentType(),
+			Size:        md.GetSize(),
+			Seq:         md.GetSeq(),
+			FileName:    md.GetFileName(),
+			FileType:    md.GetFileType(),
+			Md5:         md.GetMd5(),
+			Description: md.GetDescription(),
+		}
+	}
+	switch v := m.GetValue().(type) {
+	case *sparkplug_b.Payload_Metric_StringValue:
+		metric.ValueString = &v.StringValue
+	case *sparkplug_b.Payload_Metric_BooleanValue:
+		metric.ValueBool = &v.BooleanValue
+	case *sparkplug_b.Payload_Metric_IntValue:
+		metric.ValueInt, metric.ValueLong, metric.ValueUint64 = integerValue(m.GetDatatype(), uint64(v.IntValue), false)
+	case *sparkplug_b.Payload_Metric_LongValue:
+		metric.ValueInt, metric.ValueLong, metric.ValueUint64 = integerValue(m.GetDatatype(), v.LongValue, true)
+	case *sparkplug_b.Payload_Metric_DoubleValue:
+		metric.ValueDouble = &v.DoubleValue
+	case *sparkplug_b.Payload_Metric_FloatValue:
+		metric.ValueFloat = &v.FloatValue
+	case *sparkplug_b.Payload_Metric_DatasetValue:
+		metric.DataSet = decodeDataSet(v.DatasetValue)
+	case *sparkplug_b.Payload_Metric_TemplateValue:
+		metric.Template = decodeTemplate(v.TemplateValue)
+	case *sparkplug_b.Payload_Metric_BytesValue:
+		if isArrayType(m.GetDatatype()) {
+			if array, err := decodeArray(m.GetDatatype(), v.BytesValue); err == nil {
+				metric.Array = jsonArray(array)
+			}
+		}
+	}
+	return metric
+}
+
+// updateLKV updates the cache with the metrics of a BIRTH or DATA message.
+// A BIRTH replaces all values of its node or device, an NBIRTH also removes
+// those of the devices of the node until their own DBIRTH. An NDEATH removes
+// the values of the node and all of its devices, a DDEATH those of the device.
+// Historical metrics don't update the cache, nor do values measured before the
+// cached ones.
+func updateLKV(msg *SparkplugMessage, receivedAt time.Time) {
+	key := deviceKey(msg.GroupId, msg.EdgeNodeId, msg.DeviceId)
+
+	lkvCacheMutex.Lock()
+	defer lkvCacheMutex.Unlock()
+
+	switch msg.MessageType {
+	case "NDEATH":
+		deleteNodeLKV(msg.GroupId, msg.EdgeNodeId)
+		return
+	case "DDEATH":
+		delete(lkvCache, key)
+		return
+	case "NBIRTH":
+		deleteNodeLKV(msg.GroupId, msg.EdgeNodeId)
+		lkvCache[key] = make(map[string]MetricValue)
+	case "DBIRTH":
+		lkvCache[key] = make(map[string]MetricValue)
+	case "NDATA", "DDATA":
+	default:
+		return
+	}
+
+	values, ok := lkvCache[key]
+	if !ok {
+		values = make(map[string]MetricValue)
+		lkvCache[key] = values
+	}
+	for _, m := range msg.Payload.Metrics {
+		if m.Name == nil || m.GetIsHistorical() {
+			continue
+		}
+		value := MetricValue{Metric: metricFromPayload(m), ReceivedAt: receivedAt}
+		if cached, ok := values[value.Name]; ok && !value.Timestamp.IsZero() && value.Timestamp.Before(cached.Timestamp) {
+			continue
+		}
+		values[value.Name] = value
+	}
+}
+
+// deleteNodeLKV removes the values of a node and all of its devices.
+// The caller must hold lkvCacheMutex.
+func deleteNodeLKV(groupId string, edgeNodeId string) {
+	prefix := nodeKey(groupId, edgeNodeId) + "/"
+	for k := range lkvCache {
+		if strings.HasPrefix(k, prefix) {
+			delete(lkvCache, k)
+		}
+	}
+}
+
+// getLKV returns the last known values of a node or device, sorted by name.
+func getLKV(groupId string, nodeId string, deviceId string) []MetricValue {
+	lkvCacheMutex.RLock()
+	defer lkvCacheMutex.RUnlock()
+
+	values := lkvCache[deviceKey(groupId, nodeId, deviceId)]
+	metrics := make([]MetricValue, 0, len(values))
+	for _, value := range values {
+		metrics = append(metrics, value)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	return metrics
+}
+
+// getLKVByName returns the last known values of a node or device keyed by metric name.
+func getLKVByName(groupId string, nodeId string, deviceId string) map[string]*MetricValue {
+	metrics := getLKV(groupId, nodeId, deviceId)
+	byName := make(map[string]*MetricValue, len(metrics))
+	for i := range metrics {
+		byName[metrics[i].Name] = &metrics[i]
+	}
+	return byName
+}
+
+// loadLKV seeds the cache with the latest values stored since the last birth
+// of every node and device that has not died since.
+func loadLKV() error {
+	values, err := getAllLatestMetrics()
+	if err != nil {
+		return err
+	}
+
+	lkvCacheMutex.Lock()
+	defer lkvCacheMutex.Unlock()
+	for key, metrics := range values {
+		lkvCache[key] = metrics
+	}
+	log.Printf("Loaded last known values of %d nodes and devices.\n", len(values))
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"hostapp/sparkplug_b"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+// lkvMetric is an Int64 metric "m" measured at the given millisecond.
+func lkvMetric(timestamp uint64, value uint64, historical bool) *sparkplug_b.Payload_Metric {
+	return &sparkplug_b.Payload_Metric{
+		Name:         proto.String("m"),
+		Timestamp:    proto.Uint64(timestamp),
+		Datatype:     proto.Uint32(4),
+		IsHistorical: proto.Bool(historical),
+		Value:        &sparkplug_b.Payload_Metric_LongValue{LongValue: value},
+	}
+}
+
+// lkvValue returns the cached value of metric "m", "" if there is none.
+func lkvValue(groupId string, nodeId string, deviceId string) string {
+	if m, ok := getLKVByName(groupId, nodeId, deviceId)["m"]; ok {
+		return m.FormatValue()
+	}
+	return ""
+}
+
+func TestUpdateLKV(t *testing.T) {
+	defer func() {
+		lkvCacheMutex.Lock()
+		deleteNodeLKV("g", "n")
+		lkvCacheMutex.Unlock()
+	}()
+	message := func(messageType string, deviceId string, metrics ...*sparkplug_b.Payload_Metric) *SparkplugMessage {
+		return &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", DeviceId: deviceId, MessageType: messageType,
+			Payload: &sparkplug_b.Payload{Metrics: metrics}}
+	}
+
+	steps := []struct {
+		name   string
+		msg    *SparkplugMessage
+		node   string
+		device string
+	}{
+		{"node birth", message("NBIRTH", "", lkvMetric(10, 1, false)), "1", ""},
+		{"device birth", message("DBIRTH", "d", lkvMetric(10, 2, false)), "1", "2"},
+		{"node data", message("NDATA", "", lkvMetric(20, 3, false)), "3", "2"},
+		{"older node data", message("NDATA", "", lkvMetric(15, 4, false)), "3", "2"},
+		{"historical node data", message("NDATA", "", lkvMetric(30, 5, true)), "3", "2"},
+		{"device data", message("DDATA", "d", lkvMetric(30, 6, false)), "3", "6"},
+		{"later values of one message", message("DDATA", "d", lkvMetric(40, 7, false), lkvMetric(50, 8, false)), "3", "8"},
+		{"device death", message("DDEATH", "d"), "3", ""},
+		{"older device birth", message("DBIRTH", "d", lkvMetric(5, 9, false)), "3", "9"},
+		{"node death", message("NDEATH", ""), "", ""},
+		{"node birth without devices", message("NBIRTH", "", lkvMetric(60, 10, false)), "10", ""},
+	}
+	receivedAt := time.Now()
+	for _, step := range steps {
+		updateLKV(step.msg, receivedAt)
+		if node, device := lkvValue("g", "n", ""), lkvValue("g", "n", "d"); node != step.node || device != step.device {
+			t.Errorf("%s: got node %q, device %q, want %q, %q", step.name, node, device, step.node, step.device)
+		}
+	}
+}
+
+func TestLoadLKV(t *testing.T) {
+	defer func(saved *sqlx.DB) { db = saved }(db)
+	db = sqlx.NewDb(sql.OpenDB(fakeDB{"g/n/": true, "g/n/d": true}), "pgx")
+	defer func() {
+		lkvCacheMutex.Lock()
+		deleteNodeLKV("g", "n")
+		lkvCacheMutex.Unlock()
+	}()
+
+	if err := loadLKV(); err != nil {
+		t.Fatal(err)
+	}
+	for _, deviceId := range []string{"", "d"} {
+		if got := lkvValue("g", "n", deviceId); got != "1" {
+			t.Errorf("%q: got %q, want 1", deviceId, got)
+		}
+	}
+	if got := lkvValue("g", "other", ""); got != "" {
+		t.Errorf("other node: got %q, want none", got)
+	}
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"errors"
 	"github.com/nats-io/nats.go"
 	"log"
+	"time"
 )
 
+// sparkplugSubject matches all MQTT topics starting with "spBv1.0/".
+const sparkplugSubject = "spBv1//0.>"
+
+// startTime is the time hostapp started.
+var startTime = time.Now()
+
+// drainTimeout bounds the wait for pending messages when unsubscribing.
+const drainTimeout = 30 * time.Second
+
 var natsCon *nats.Conn
 var natsSub *nats.Subscription
 
@@ -19,8 +30,16 @@ func connectNats() error {
 	natsCon = nc
 	log.Println("Connected to NATS.")
 
-	// Subscribe to all MQTT topics starting with "spBv1.0/"
-	sub, err := nc.Subscribe("spBv1//0.>", onReceive)
+	if useJetStream {
+		sub, err := subscribeJetStream(nc)
+		if err != nil {
+			return err
+		}
+		natsSub = sub
+		return nil
+	}
+
+	sub, err := nc.Subscribe(sparkplugSubject, onReceive)
 	if err != nil {
 		return err
 	}
@@ -28,25 +47,79 @@ func connectNats() error {
 	return nil
 }
 
-func disconnectNats() error {
-	err := natsSub.Unsubscribe()
-	if err != nil {
+// unsubscribeNats stops the delivery of new messages and waits until the
+// messages already delivered have been handed to the ingestion workers, so
+// the ingestion can be stopped afterwards.
+func unsubscribeNats() error {
+	if useJetStream {
+		// the consumer goroutine processes the fetched messages itself
+		stopJetStream()
+		return natsSub.Unsubscribe()
+	}
+	if err := natsSub.Drain(); err != nil {
 		return err
 	}
+	deadline := time.Now().Add(drainTimeout)
+	for natsSub.IsValid() {
+		if time.Now().After(deadline) {
+			return errors.New("timeout draining the NATS subscription")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func disconnectNats() error {
 	natsCon.Close()
 	return nil
 }
 
 func onReceive(msg *nats.Msg) {
-	sparkplugMsg, err := decodeSparkplugMessage(msg.Subject, msg.Data)
+	err := processSparkplugMessage(msg.Subject, msg.Data, time.Now(), false, nil)
 	if err != nil {
 		log.Printf("Error during unmarshalling: %v", err)
-		return
 	}
-	log.Printf("Received: %s Msg: %s", msg.Subject, sparkplugMsg)
-	err = storeSparkplugMessageToDB(sparkplugMsg)
+}
+
+// processSparkplugMessage decodes a message and hands it to the ingestion workers.
+// ack, if not nil, is called once the message has been written to the database.
+// Only a message received while hostapp runs, for the first time, is streamed
+// to the web UI, counts as activity of its node and may trigger a rebirth
+// request; a message of the JetStream backlog or a replayed one happened before.
+// The sequence number of a redelivered message has already been checked.
+func processSparkplugMessage(subject string, data []byte, receivedAt time.Time, redelivered bool, ack func(error)) error {
+	sparkplugMsg, err := decodeSparkplugMessage(subject, data)
 	if err != nil {
-		log.Printf("Error saving to DB: %v", err)
-		return
+		return err
+	}
+	log.Printf("Received: %s Msg: %v", subject, sparkplugMsg)
+	live := !redelivered && !receivedAt.Before(startTime)
+	resolveAliases(sparkplugMsg)
+	expandTemplates(sparkplugMsg)
+	if live {
+		publishLive(sparkplugMsg, receivedAt)
 	}
+	item := ingestItem{msg: sparkplugMsg, receivedAt: receivedAt, ack: ack}
+	if storeRawPayload {
+		item.body = data
+	}
+
+	accepted, expectedBdSeq := checkSession(sparkplugMsg)
+	if accepted {
+		if !redelivered {
+			trackSequence(sparkplugMsg, receivedAt, live)
+		}
+		updateLKV(sparkplugMsg, receivedAt)
+		if live {
+			trackActivity(sparkplugMsg, time.Now())
+		}
+	} else {
+		log.Printf("Ignoring NDEATH of %v/%v with bdSeq %v, current session has bdSeq %v",
+			sparkplugMsg.GroupId, sparkplugMsg.EdgeNodeId, formatSeq(bdSeqOf(sparkplugMsg.Payload)), formatSeq(expectedBdSeq))
+		item.ignoredDeath = true
+		item.expectedBdSeq = expectedBdSeq
+	}
+
+	enqueueIngestItem(item)
+	return nil
 }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"google.golang.org/protobuf/proto"
+	"hostapp/sparkplug_b"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions in this file build the PostgreSQL text representation of the
+// composite types declared in timescale_init.sql (metric_type, propertyset_type, ...).
+// The resulting literals are never spliced into SQL; they are passed as bound
+// parameters and cast on the server side, e.g. $6::text::metric_type[], or
+// streamed to the server as COPY data.
+// A nil *string always stands for SQL NULL. Strings are escaped byte by byte,
+// so invalid UTF-8 reaches the server unchanged, where it is rejected rather
+// than stored as a different value.
+
+const pgTimestampFormat = "2006-01-02T15:04:05.999999Z07:00"
+
+// quoteCompositeField quotes a single field of a composite literal. Every
+// non-null field is quoted so that empty strings, commas, parentheses and
+// whitespace survive unchanged.
+func quoteCompositeField(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte(s[i])
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// quoteArrayElement quotes a single element of an array literal.
+func quoteArrayElement(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// compositeLiteral returns the literal of a row with the given fields, e.g. ("a",,"1").
+func compositeLiteral(fields ...*string) *string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i, field := range fields {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		if field != nil {
+			sb.WriteString(quoteCompositeField(*field))
+		}
+	}
+	sb.WriteByte(')')
+	literal := sb.String()
+	return &literal
+}
+
+// arrayLiteral returns the literal of a one-dimensional array, e.g. {"a",NULL}.
+func arrayLiteral(elements []*string) *string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, element := range elements {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		if element == nil {
+			sb.WriteString("NULL")
+		} else {
+			sb.WriteString(quoteArrayElement(*element))
+		}
+	}
+	sb.WriteByte('}')
+	literal := sb.String()
+	return &literal
+}
+
+func pgText(s string) *string {
+	return &s
+}
+
+func pgInt(v int64) *string {
+	s := strconv.FormatInt(v, 10)
+	return &s
+}
+
+func pgUint(v uint64) *string {
+	s := strconv.FormatUint(v, 10)
+	return &s
+}
+
+func pgBool(v bool) *string {
+	s := strconv.FormatBool(v)
+	return &s
+}
+
+func pgFloat(v float64, bitSize int) *string {
+	var s string
+	switch {
+	case math.IsNaN(v):
+		s = "NaN"
+	case math.IsInf(v, 1):
+		s = "Infinity"
+	case math.IsInf(v, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.FormatFloat(v, 'g', -1, bitSize)
+	}
+	return &s
+}
+
+func pgTimestamp(t time.Time) *string {
+	s := t.UTC().Format(pgTimestampFormat)
+	return &s
+}
+
+// optBytea encodes bytes in the hex format of bytea, NULL for nil.
+func optBytea(b []byte) *string {
+	if b == nil {
+		return nil
+	}
+	s := `\x` + hex.EncodeToString(b)
+	return &s
+}
+
+func optText(v *string) *string {
+	if v == nil {
+		return nil
+	}
+	return pgText(*v)
+}
+
+func optUint(v *uint64) *string {
+	if v == nil {
+		return nil
+	}
+	return pgUint(*v)
+}
+
+func optUint32(v *uint32) *string {
+	if v == nil {
+		return nil
+	}
+	return pgUint(uint64(*v))
+}
+
+func optBool(v *bool) *string {
+	if v == nil {
+		return nil
+	}
+	return pgBool(*v)
+}
+
+// optMillis converts a Sparkplug timestamp (milliseconds since epoch, UTC).
+func optMillis(v *uint64) *string {
+	if v == nil {
+		return nil
+	}
+	return pgTimestamp(time.UnixMilli(int64(*v)))
+}
+
+// metricsLiteral encodes the metrics of a payload as a metric_type[] literal.
+func metricsLiteral(metrics []*sparkplug_b.Payload_Metric) *string {
+	if metrics == nil {
+		return nil
+	}
+	elements := make([]*string, len(metrics))
+	for i, metric := range metrics {
+		elements[i] = metricLiteral(metric)
+	}
+	return arrayLiteral(elements)
+}
+
+// metricLiteral encodes a single metric as a metric_type literal.
+func metricLiteral(m *sparkplug_b.Payload_Metric) *string {
+	var valueString, valueBool, valueInt, valueLong, valueUint64, valueDouble, valueFloat *string
+	var valueDataSet, valueTemplate, valueArray *string
+	switch v := m.GetValue().(type) {
+	case *sparkplug_b.Payload_Metric_StringValue:
+		valueString = pgText(v.StringValue)
+	case *sparkplug_b.Payload_Metric_BooleanValue:
+		valueBool = pgBool(v.BooleanValue)
+	case *sparkplug_b.Payload_Metric_IntValue:
+		valueInt, valueLong, valueUint64 = integerLiterals(integerValue(m.GetDatatype(), uint64(v.IntValue), false))
+	case *sparkplug_b.Payload_Metric_LongValue:
+		valueInt, valueLong, valueUint64 = integerLiterals(integerValue(m.GetDatatype(), v.LongValue, true))
+	case *sparkplug_b.Payload_Metric_DoubleValue:
+		valueDouble = pgFloat(v.DoubleValue, 64)
+	case *sparkplug_b.Payload_Metric_FloatValue:
+		valueFloat = pgFloat(float64(v.FloatValue), 32)
+	case *sparkplug_b.Payload_Metric_DatasetValue:
+		valueDataSet = dataSetLiteral(v.DatasetValue)
+	case *sparkplug_b.Payload_Metric_TemplateValue:
+		valueTemplate = templateLiteral(v.TemplateValue)
+	case *sparkplug_b.Payload_Metric_BytesValue:
+		valueArray = valueArrayLiteral(m.GetDatatype(), v.BytesValue)
+	}
+
+	return compositeLiteral(
+		optText(m.Name),
+		optUint(m.Alias),
+		optMillis(m.Timestamp),
+		optUint32(m.Datatype),
+		optBool(m.IsHistorical),
+		optBool(m.IsTransient),
+		optBool(m.IsNull),
+		metadataLiteral(m.Metadata),
+		propertySetLiteral(m.Properties),
+		valueString,
+		valueBool,
+		valueInt,
+		valueUint64,
+		valueDouble,
+		valueFloat,
+		valueDataSet,
+		valueTemplate,
+		valueArray,
+		valueLong,
+	)
+}
+
+// integerLiterals encodes the values returned by integerValue.
+func integerLiterals(valueInt *int32, valueLong *int64, valueUint64 *uint64) (*string, *string, *string) {
+	var i, l, u *string
+	if valueInt != nil {
+		i = pgInt(int64(*valueInt))
+	}
+	if valueLong != nil {
+		l = pgInt(*valueLong)
+	}
+	if valueUint64 != nil {
+		u = pgUint(*valueUint64)
+	}
+	return i, l, u
+}
+
+// dataSetLiteral encodes a DataSet as the JSON stored in value_dataset.
+func dataSetLiteral(ds *sparkplug_b.Payload_DataSet) *string {
+	if ds == nil {
+		return nil
+	}
+	data, err := json.Marshal(decodeDataSet(ds))
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// templateLiteral encodes a template as the JSON stored in value_template.
+func templateLiteral(t *sparkplug_b.Payload_Template) *string {
+	if t == nil {
+		return nil
+	}
+	data, err := json.Marshal(decodeTemplate(t))
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// valueArrayLiteral decodes the bytes_value of an array metric and encodes its
+// elements as the JSON stored in value_array. NULL for other datatypes and
+// arrays that cannot be decoded.
+func valueArrayLiteral(datatype uint32, b []byte) *string {
+	if !isArrayType(datatype) {
+		return nil
+	}
+	array, err := decodeArray(datatype, b)
+	if err != nil {
+		log.Printf("Cannot decode %v: %v", DataTypes[int(datatype)], err)
+		return nil
+	}
+	data, err := json.Marshal(jsonArray(array))
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// metadataLiteral encodes the metadata of a metric as a metadata_type literal.
+func metadataLiteral(md *sparkplug_b.Payload_MetaData) *string {
+	if md == nil {
+		return nil
+	}
+	var size, seq *string
+	if md.Size != nil {
+		size = pgUint(*md.Size)
+	}
+	if md.Seq != nil {
+		seq = pgUint(*md.Seq)
+	}
+	return compositeLiteral(
+		optBool(md.IsMultiPart),
+		optText(md.ContentType),
+		size,
+		seq,
+		optText(md.FileName),
+		optText(md.FileType),
+		optText(md.Md5),
+		optText(md.Description),
+	)
+}
+
+// propertySetLiteral encodes a property set as a propertyset_type literal.
+func propertySetLiteral(ps *sparkplug_b.Payload_PropertySet) *string {
+	if ps == nil {
+		return nil
+	}
+	keys := make([]*string, len(ps.Keys))
+	for i, key := range ps.Keys {
+		keys[i] = pgText(key)
+	}
+	values := make([]*string, len(ps.Values))
+	for i, value := range ps.Values {
+		values[i] = propertyValueLiteral(value)
+	}
+	return compositeLiteral(arrayLiteral(keys), arrayLiteral(values))
+}
+
+// propertyValueLiteral encodes a property value as a propertyvalue_type literal.
+// Integers are stored in the column matching their type, like metric values.
+// Nested property sets are stored as JSON in propertyset_value and propertysets_value.
+func propertyValueLiteral(pv *sparkplug_b.Payload_PropertyValue) *string {
+	if pv == nil {
+		return nil
+	}
+	var intValue, longValue, uint64Value, floatValue, doubleValue, booleanValue, stringValue *string
+	var propertySetValue, propertySetsValue *string
+	switch v := pv.GetValue().(type) {
+	case *sparkplug_b.Payload_PropertyValue_IntValue:
+		intValue, longValue, uint64Value = integerLiterals(integerValue(pv.GetType(), uint64(v.IntValue), false))
+	case *sparkplug_b.Payload_PropertyValue_LongValue:
+		intValue, longValue, uint64Value = integerLiterals(integerValue(pv.GetType(), v.LongValue, true))
+	case *sparkplug_b.Payload_PropertyValue_FloatValue:
+		floatValue = pgFloat(float64(v.FloatValue), 32)
+	case *sparkplug_b.Payload_PropertyValue_DoubleValue:
+		doubleValue = pgFloat(v.DoubleValue, 64)
+	case *sparkplug_b.Payload_PropertyValue_BooleanValue:
+		booleanValue = pgBool(v.BooleanValue)
+	case *sparkplug_b.Payload_PropertyValue_StringValue:
+		stringValue = pgText(v.StringValue)
+	case *sparkplug_b.Payload_PropertyValue_PropertysetValue:
+		propertySetValue = jsonLiteral(propertySetJSON(v.PropertysetValue))
+	case *sparkplug_b.Payload_PropertyValue_PropertysetsValue:
+		propertySetsValue = jsonLiteral(propertySetListJSON(v.PropertysetsValue))
+	}
+	return compositeLiteral(
+		optUint32(pv.Type),
+		optBool(pv.IsNull),
+		intValue,
+		longValue,
+		floatValue,
+		doubleValue,
+		booleanValue,
+		stringValue,
+		propertySetValue,
+		propertySetsValue,
+		uint64Value,
+	)
+}
+
+// propertySetJSON converts a nested property set to the JSON form of a
+// propertyset_type, as returned by to_jsonb.
+func propertySetJSON(ps *sparkplug_b.Payload_PropertySet) *propertySetRow {
+	if ps == nil {
+		return nil
+	}
+	row := &propertySetRow{Keys: []*string{}, Values: []*propertyValueRow{}}
+	for i, key := range ps.GetKeys() {
+		row.Keys = append(row.Keys, proto.String(key))
+		var pv *sparkplug_b.Payload_PropertyValue
+		if i < len(ps.GetValues()) {
+			pv = ps.GetValues()[i]
+		}
+		row.Values = append(row.Values, propertyValueJSON(pv))
+	}
+	return row
+}
+
+func propertyValueJSON(pv *sparkplug_b.Payload_PropertyValue) *propertyValueRow {
+	if pv == nil {
+		return nil
+	}
+	row := &propertyValueRow{IsNull: pv.IsNull}
+	if pv.Type != nil {
+		row.Type = proto.Int32(int32(*pv.Type))
+	}
+	switch v := pv.GetValue().(type) {
+	case *sparkplug_b.Payload_PropertyValue_IntValue:
+		row.IntValue, row.LongValue, row.Uint64Value = integerValue(pv.GetType(), uint64(v.IntValue), false)
+	case *sparkplug_b.Payload_PropertyValue_LongValue:
+		row.IntValue, row.LongValue, row.Uint64Value = integerValue(pv.GetType(), v.LongValue, true)
+	case *sparkplug_b.Payload_PropertyValue_FloatValue:
+		f := jsonFloat(v.FloatValue)
+		row.FloatValue = &f
+	case *sparkplug_b.Payload_PropertyValue_DoubleValue:
+		f := jsonFloat(v.DoubleValue)
+		row.DoubleValue = &f
+	case *sparkplug_b.Payload_PropertyValue_BooleanValue:
+		row.BooleanValue = proto.Bool(v.BooleanValue)
+	case *sparkplug_b.Payload_PropertyValue_StringValue:
+		row.StringValue = proto.String(v.StringValue)
+	case *sparkplug_b.Payload_PropertyValue_PropertysetValue:
+		row.PropertySetValue = propertySetJSON(v.PropertysetValue)
+	case *sparkplug_b.Payload_PropertyValue_PropertysetsValue:
+		row.PropertySetsValue = propertySetListJSON(v.PropertysetsValue)
+	}
+	return row
+}
+
+func propertySetListJSON(list *sparkplug_b.Payload_PropertySetList) []*propertySetRow {
+	rows := []*propertySetRow{}
+	for _, ps := range list.GetPropertyset() {
+		rows = append(rows, propertySetJSON(ps))
+	}
+	return rows
+}
+
+// jsonLiteral encodes v as the text of a JSONB value, NULL if it cannot be encoded.
+func jsonLiteral(v interface{}) *string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// writeCopyField appends a field in the text format of COPY FROM STDIN.
+func writeCopyField(buf *bytes.Buffer, field *string) {
+	if field == nil {
+		buf.WriteString(`\N`)
+		return
+	}
+	s := *field
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+}
+
+// writeCopyRow appends a tab separated row in the text format of COPY FROM STDIN.
+func writeCopyRow(buf *bytes.Buffer, fields ...*string) {
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+		writeCopyField(buf, field)
+	}
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hostapp/sparkplug_b"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// parseCompositeLiteral splits the text representation of a row, as returned by
+// the server, into its fields. nil marks a NULL field.
+func parseCompositeLiteral(literal string) ([]*string, error) {
+	if !strings.HasPrefix(literal, "(") || !strings.HasSuffix(literal, ")") {
+		return nil, fmt.Errorf("not a composite literal: %q", literal)
+	}
+	return parseLiteralList(literal[1:len(literal)-1], true)
+}
+
+// parseArrayLiteral splits the text representation of a one-dimensional array
+// into its elements. nil marks a NULL element.
+func parseArrayLiteral(literal string) ([]*string, error) {
+	if !strings.HasPrefix(literal, "{") || !strings.HasSuffix(literal, "}") {
+		return nil, fmt.Errorf("not an array literal: %q", literal)
+	}
+	if literal == "{}" {
+		return []*string{}, nil
+	}
+	return parseLiteralList(literal[1:len(literal)-1], false)
+}
+
+// parseLiteralList splits the body of a composite or array literal at the
+// commas outside of quotes and removes the quoting. In a composite an empty
+// unquoted field is NULL, in an array an unquoted NULL.
+func parseLiteralList(body string, composite bool) ([]*string, error) {
+	var result []*string
+	var sb strings.Builder
+	quoted, inQuotes, escaped := false, false, false
+	flush := func() {
+		s := sb.String()
+		switch {
+		case quoted:
+			result = append(result, &s)
+		case composite && s == "", !composite && s == "NULL":
+			result = append(result, nil)
+		default:
+			result = append(result, &s)
+		}
+		sb.Reset()
+		quoted = false
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case escaped:
+			sb.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case inQuotes && c == '"' && composite && i+1 < len(body) && body[i+1] == '"':
+			sb.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case c == ',' && !inQuotes:
+			flush()
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if inQuotes || escaped {
+		return nil, fmt.Errorf("unterminated literal: %q", body)
+	}
+	flush()
+	return result, nil
+}
+
+// toJSONB renders a metric_type literal written by metricLiteral the way the
+// server's to_jsonb does, as read back by Metric.Scan.
+func toJSONB(t *testing.T, literal string) []byte {
+	t.Helper()
+	fields := parseComposite(t, literal)
+	row := map[string]interface{}{}
+	for i, column := range []string{"name", "alias", "timestamp", "datatype", "is_historical", "is_transient",
+		"is_null", "metadata", "properties", "value_string", "value_bool", "value_int", "value_uint64",
+		"value_double", "value_float", "value_dataset", "value_template", "value_array", "value_long"} {
+		row[column] = jsonbField(t, column, fields[i])
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func jsonbField(t *testing.T, column string, field *string) interface{} {
+	t.Helper()
+	if field == nil {
+		return nil
+	}
+	switch column {
+	case "name", "timestamp", "value_string", "content_type", "file_name", "file_type", "md5", "description",
+		"string_value":
+		return *field
+	case "is_historical", "is_transient", "is_null", "value_bool", "is_multi_part", "boolean_value":
+		return *field == "true"
+	case "value_double", "value_float", "float_value", "double_value":
+		if _, err := strconv.ParseFloat(*field, 64); err != nil || strings.ContainsAny(*field, "aA") {
+			return *field // NaN and Infinity
+		}
+		return json.RawMessage(*field)
+	case "value_dataset", "value_template", "value_array", "propertyset_value", "propertysets_value":
+		return json.RawMessage(*field)
+	case "metadata":
+		return jsonbComposite(t, *field, "is_multi_part", "content_type", "size", "seq", "file_name", "file_type",
+			"md5", "description")
+	case "properties":
+		properties := parseComposite(t, *field)
+		var keys []interface{}
+		for _, key := range parseArray(t, *properties[0]) {
+			keys = append(keys, jsonbField(t, "name", key))
+		}
+		var values []interface{}
+		for _, value := range parseArray(t, *properties[1]) {
+			values = append(values, jsonbComposite(t, *value, "type", "is_null", "int_value", "long_value",
+				"float_value", "double_value", "boolean_value", "string_value", "propertyset_value",
+				"propertysets_value", "uint64_value"))
+		}
+		return map[string]interface{}{"keys": keys, "values": values}
+	}
+	return json.RawMessage(*field) // integers
+}
+
+func jsonbComposite(t *testing.T, literal string, columns ...string) map[string]interface{} {
+	t.Helper()
+	fields := parseComposite(t, literal)
+	if len(fields) != len(columns) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(columns))
+	}
+	object := map[string]interface{}{}
+	for i, column := range columns {
+		object[column] = jsonbField(t, column, fields[i])
+	}
+	return object
+}
+
+// parseComposite splits a composite literal into its fields. nil marks a NULL field.
+func parseComposite(t *testing.T, literal string) []*string {
+	t.Helper()
+	fields, err := parseCompositeLiteral(literal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// parseArray splits a one-dimensional array literal into its elements.
+func parseArray(t *testing.T, literal string) []*string {
+	t.Helper()
+	elements, err := parseArrayLiteral(literal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return elements
+}
+
+var awkwardStrings = []string{
+	"",
+	"plain",
+	"it's",
+	`say "hi"`,
+	`back\slash`,
+	`\\double\\`,
+	`"\`,
+	"comma, and (parens)",
+	"{braces}",
+	"NULL",
+	"'); DROP TABLE data; --",
+	"tab\tnew\nline",
+	"Grüße, 温度, 🌡️",
+	"<b>&amp;</b>",
+	strings.Repeat(`long "quoted" \ value, `, 5000),
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	elements := make([]*string, 0, len(awkwardStrings)+1)
+	for _, s := range awkwardStrings {
+		elements = append(elements, pgText(s))
+	}
+	elements = append(elements, nil)
+
+	fields := parseComposite(t, *compositeLiteral(elements...))
+	array := parseArray(t, *arrayLiteral(elements))
+	for name, got := range map[string][]*string{"composite": fields, "array": array} {
+		if len(got) != len(elements) {
+			t.Fatalf("%s: got %d fields, want %d", name, len(got), len(elements))
+		}
+		for i, want := range elements {
+			if want == nil {
+				if got[i] != nil {
+					t.Errorf("%s: field %d: got %q, want NULL", name, i, *got[i])
+				}
+				continue
+			}
+			if got[i] == nil || *got[i] != *want {
+				t.Errorf("%s: field %d: got %v, want %q", name, i, got[i], *want)
+			}
+		}
+	}
+}
+
+func TestQuoteInvalidUTF8(t *testing.T) {
+	invalid := "bad \xff\xfe \"q\" \\ \xc3( \t\xe2\x82"
+	if got := parseComposite(t, *compositeLiteral(pgText(invalid))); len(got) != 1 || got[0] == nil || *got[0] != invalid {
+		t.Errorf("composite: got %v, want %q", got, invalid)
+	}
+	if got := parseArray(t, *arrayLiteral([]*string{pgText(invalid)})); len(got) != 1 || got[0] == nil || *got[0] != invalid {
+		t.Errorf("array: got %v, want %q", got, invalid)
+	}
+	var buffer bytes.Buffer
+	writeCopyField(&buffer, pgText(invalid))
+	if want := "bad \xff\xfe \"q\" \\\\ \xc3( \\t\xe2\x82"; buffer.String() != want {
+		t.Errorf("COPY field: got %q, want %q", buffer.String(), want)
+	}
+}
+
+func TestMetricLiteral(t *testing.T) {
+	for _, s := range awkwardStrings {
+		metric := &sparkplug_b.Payload_Metric{
+			Name:     proto.String(s),
+			Alias:    proto.Uint64(7),
+			Datatype: proto.Uint32(12),
+			Value:    &sparkplug_b.Payload_Metric_StringValue{StringValue: s},
+			Properties: &sparkplug_b.Payload_PropertySet{
+				Keys: []string{s},
+				Values: []*sparkplug_b.Payload_PropertyValue{
+					{Type: proto.Uint32(12), Value: &sparkplug_b.Payload_PropertyValue_StringValue{StringValue: s}},
+				},
+			},
+		}
+
+		metrics := parseArray(t, *metricsLiteral([]*sparkplug_b.Payload_Metric{metric}))
+		if len(metrics) != 1 {
+			t.Fatalf("got %d metrics, want 1", len(metrics))
+		}
+		fields := parseComposite(t, *metrics[0])
+		if len(fields) != 19 {
+			t.Fatalf("got %d metric fields, want 19", len(fields))
+		}
+		if *fields[0] != s {
+			t.Errorf("name: got %q, want %q", *fields[0], s)
+		}
+		if *fields[9] != s {
+			t.Errorf("value_string: got %q, want %q", *fields[9], s)
+		}
+		if fields[10] != nil || fields[11] != nil {
+			t.Errorf("unexpected non-string values: %v %v", fields[10], fields[11])
+		}
+
+		properties := parseComposite(t, *fields[8])
+		keys := parseArray(t, *properties[0])
+		if len(keys) != 1 || *keys[0] != s {
+			t.Errorf("property key: got %v, want %q", keys, s)
+		}
+		values := parseArray(t, *properties[1])
+		value := parseComposite(t, *values[0])
+		if *value[7] != s {
+			t.Errorf("property string_value: got %q, want %q", *value[7], s)
+		}
+
+		var got Metric
+		if err := got.Scan(toJSONB(t, *metrics[0])); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != s || got.ValueString == nil || *got.ValueString != s || got.Alias == nil || *got.Alias != 7 {
+			t.Errorf("scan: got %q %v %v", got.Name, got.ValueString, got.Alias)
+		}
+		if got.Properties == nil || len(got.Properties.Keys) != 1 || got.Properties.Keys[0] != s ||
+			got.Properties.Values[0].StringValue == nil || *got.Properties.Values[0].StringValue != s {
+			t.Errorf("scan properties: got %+v", got.Properties)
+		}
+	}
+}
+
+func TestNestedPropertySetRoundTrip(t *testing.T) {
+	leaf := func(key string, value string) *sparkplug_b.Payload_PropertySet {
+		return &sparkplug_b.Payload_PropertySet{
+			Keys: []string{key},
+			Values: []*sparkplug_b.Payload_PropertyValue{
+				{Type: proto.Uint32(12), Value: &sparkplug_b.Payload_PropertyValue_StringValue{StringValue: value}},
+			},
+		}
+	}
+	metric := &sparkplug_b.Payload_Metric{
+		Name:     proto.String("temperature"),
+		Datatype: proto.Uint32(10),
+		Properties: &sparkplug_b.Payload_PropertySet{
+			Keys: []string{"engUnit", "limits", "alarms", "empty"},
+			Values: []*sparkplug_b.Payload_PropertyValue{
+				{Type: proto.Uint32(12), Value: &sparkplug_b.Payload_PropertyValue_StringValue{StringValue: "°C"}},
+				{Type: proto.Uint32(20), Value: &sparkplug_b.Payload_PropertyValue_PropertysetValue{
+					PropertysetValue: &sparkplug_b.Payload_PropertySet{
+						Keys: []string{"high", "display"},
+						Values: []*sparkplug_b.Payload_PropertyValue{
+							{Type: proto.Uint32(10), Value: &sparkplug_b.Payload_PropertyValue_DoubleValue{DoubleValue: math.Inf(1)}},
+							{Type: proto.Uint32(20), Value: &sparkplug_b.Payload_PropertyValue_PropertysetValue{
+								PropertysetValue: leaf("format", `"%.1f", (quoted)`),
+							}},
+						},
+					},
+				}},
+				{Type: proto.Uint32(21), Value: &sparkplug_b.Payload_PropertyValue_PropertysetsValue{
+					PropertysetsValue: &sparkplug_b.Payload_PropertySetList{
+						Propertyset: []*sparkplug_b.Payload_PropertySet{leaf("name", "high"), leaf("name", "low")},
+					},
+				}},
+				{Type: proto.Uint32(21), Value: &sparkplug_b.Payload_PropertyValue_PropertysetsValue{
+					PropertysetsValue: &sparkplug_b.Payload_PropertySetList{},
+				}},
+			},
+		},
+	}
+
+	var got Metric
+	if err := got.Scan(toJSONB(t, *metricLiteral(metric))); err != nil {
+		t.Fatal(err)
+	}
+	ps := got.Properties
+	if ps == nil || !reflect.DeepEqual(ps.Keys, []string{"engUnit", "limits", "alarms", "empty"}) {
+		t.Fatalf("properties: got %+v", ps)
+	}
+	if ps.Values[0].FormatValue() != "°C" {
+		t.Errorf("engUnit: got %q", ps.Values[0].FormatValue())
+	}
+	limits := ps.Values[1].PropertySetValue
+	if ps.Values[1].Type != 20 || limits == nil || !reflect.DeepEqual(limits.Keys, []string{"high", "display"}) {
+		t.Fatalf("limits: got %+v", ps.Values[1])
+	}
+	if limits.Values[0].FormatValue() != "+Inf" {
+		t.Errorf("limits/high: got %q", limits.Values[0].FormatValue())
+	}
+	if display := limits.Values[1].PropertySetValue; display == nil || display.Values[0].FormatValue() != `"%.1f", (quoted)` {
+		t.Errorf("limits/display: got %+v", display)
+	}
+	alarms := ps.Values[2].PropertySetsValue
+	if len(alarms) != 2 || alarms[0].Values[0].FormatValue() != "high" || alarms[1].Values[0].FormatValue() != "low" {
+		t.Errorf("alarms: got %+v", alarms)
+	}
+	if ps.Values[3].Type != 21 || len(ps.Values[3].PropertySetsValue) != 0 {
+		t.Errorf("empty: got %+v", ps.Values[3])
+	}
+}
+
+// TestMetricScan reads the output of to_jsonb for a metric_type as returned by the server.
+func TestMetricScan(t *testing.T) {
+	row := `{"name": "a, \"b\" (c)", "alias": null, "timestamp": "2023-11-14T23:13:20.123+01:00", "datatype": 10,
+		"is_historical": true, "is_transient": null, "is_null": false,
+		"metadata": {"is_multi_part": null, "content_type": "text/plain", "size": 12, "seq": null,
+			"file_name": null, "file_type": null, "md5": null, "description": "x"},
+		"properties": {"keys": ["engUnit", "quality"], "values": [
+			{"type": 12, "is_null": null, "int_value": null, "long_value": null, "float_value": null,
+				"double_value": null, "boolean_value": null, "string_value": "°C"},
+			{"type": 10, "is_null": false, "int_value": null, "long_value": null, "float_value": null,
+				"double_value": "-Infinity", "boolean_value": null, "string_value": null}]},
+		"value_string": null, "value_bool": null, "value_int": null, "value_uint64": null,
+		"value_double": "NaN", "value_float": null, "value_dataset": null, "value_template": null,
+		"value_array": null, "value_long": null}`
+
+	var got Metric
+	if err := got.Scan([]byte(row)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != `a, "b" (c)` || got.Alias != nil || !got.Timestamp.Equal(time.UnixMilli(1700000000123)) ||
+		got.DataType != 10 || !got.IsHistorical || got.IsTransient {
+		t.Errorf("got %+v", got)
+	}
+	if got.ValueDouble == nil || !math.IsNaN(*got.ValueDouble) || got.FormatValue() != "NaN" {
+		t.Errorf("value_double: got %v", got.ValueDouble)
+	}
+	if got.Metadata == nil || *got.Metadata != (MetaData{ContentType: "text/plain", Size: 12, Description: "x"}) {
+		t.Errorf("metadata: got %+v", got.Metadata)
+	}
+	if got.Properties == nil || !reflect.DeepEqual(got.Properties.Keys, []string{"engUnit", "quality"}) ||
+		*got.Properties.Values[0].StringValue != "°C" || !math.IsInf(*got.Properties.Values[1].DoubleValue, -1) {
+		t.Errorf("properties: got %+v", got.Properties)
+	}
+
+	metrics, err := parseMetrics([]byte(fmt.Sprintf(`[%s, {"name": "b", "value_uint64": 18446744073709551615}]`, row)))
+	if err != nil || len(metrics) != 2 || metrics[0].Name != got.Name || metrics[1].FormatValue() != "18446744073709551615" {
+		t.Errorf("parseMetrics: got %+v, %v", metrics, err)
+	}
+	if metrics, err := parseMetrics(nil); err != nil || metrics != nil {
+		t.Errorf("parseMetrics of NULL: got %v, %v", metrics, err)
+	}
+}
+
+func TestMetricLiteralZeroValues(t *testing.T) {
+	metric := &sparkplug_b.Payload_Metric{
+		Name:     proto.String("flag"),
+		Datatype: proto.Uint32(11),
+		Value:    &sparkplug_b.Payload_Metric_BooleanValue{BooleanValue: false},
+	}
+	fields := parseComposite(t, *metricLiteral(metric))
+	if fields[10] == nil || *fields[10] != "false" {
+		t.Errorf("value_bool: got %v, want false", fields[10])
+	}
+	if fields[1] != nil || fields[2] != nil {
+		t.Errorf("unset alias and timestamp must be NULL")
+	}
+}
+
+func TestMetricMetadataRoundTrip(t *testing.T) {
+	for _, s := range awkwardStrings {
+		metric := &sparkplug_b.Payload_Metric{
+			Name:      proto.String(s),
+			Timestamp: proto.Uint64(1700000000123),
+			Datatype:  proto.Uint32(17),
+			Metadata: &sparkplug_b.Payload_MetaData{
+				IsMultiPart: proto.Bool(true),
+				ContentType: proto.String(s),
+				Size:        proto.Uint64(1 << 40),
+				Seq:         proto.Uint64(3),
+				FileName:    proto.String(s),
+				FileType:    proto.String("bin"),
+				Md5:         proto.String("d41d8cd98f00b204e9800998ecf8427e"),
+				Description: proto.String(s),
+			},
+		}
+
+		var got Metric
+		if err := got.Scan(toJSONB(t, *metricLiteral(metric))); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != s || !got.Timestamp.Equal(time.UnixMilli(1700000000123)) || got.DataType != 17 {
+			t.Errorf("got %q %v %v", got.Name, got.Timestamp, got.DataType)
+		}
+		want := MetaData{
+			IsMultiPart: true,
+			ContentType: s,
+			Size:        1 << 40,
+			Seq:         3,
+			FileName:    s,
+			FileType:    "bin",
+			Md5:         "d41d8cd98f00b204e9800998ecf8427e",
+			Description: s,
+		}
+		if got.Metadata == nil || *got.Metadata != want {
+			t.Errorf("metadata: got %+v, want %+v", got.Metadata, want)
+		}
+	}
+
+	var got Metric
+	if err := got.Scan(toJSONB(t, *metricLiteral(&sparkplug_b.Payload_Metric{Name: proto.String("plain")}))); err != nil {
+		t.Fatal(err)
+	}
+	if got.Metadata != nil {
+		t.Errorf("metadata: got %+v, want nil", got.Metadata)
+	}
+}
+
+func TestDataSetRoundTrip(t *testing.T) {
+	ds := &sparkplug_b.Payload_DataSet{
+		NumOfColumns: proto.Uint64(4),
+		Columns:      []string{"name, \"quoted\"", "count", "big", "ratio"},
+		Types:        []uint32{12, 3, 4, 10},
+		Rows: []*sparkplug_b.Payload_DataSet_Row{
+			{Elements: []*sparkplug_b.Payload_DataSet_DataSetValue{
+				{Value: &sparkplug_b.Payload_DataSet_DataSetValue_StringValue{StringValue: "'); DROP TABLE data; --"}},
+				{Value: &sparkplug_b.Payload_DataSet_DataSetValue_IntValue{IntValue: uint32(0xffffffff)}},
+				{Value: &sparkplug_b.Payload_DataSet_DataSetValue_LongValue{LongValue: 1<<63 - 1}},
+				{Value: &sparkplug_b.Payload_DataSet_DataSetValue_DoubleValue{DoubleValue: math.NaN()}},
+			}},
+			{Elements: []*sparkplug_b.Payload_DataSet_DataSetValue{{}, {}, {}, {}}},
+		},
+	}
+	metric := &sparkplug_b.Payload_Metric{
+		Name:     proto.String("table"),
+		Datatype: proto.Uint32(16),
+		Value:    &sparkplug_b.Payload_Metric_DatasetValue{DatasetValue: ds},
+	}
+
+	var got Metric
+	if err := got.Scan(toJSONB(t, *metricLiteral(metric))); err != nil {
+		t.Fatal(err)
+	}
+	if got.DataSet == nil {
+		t.Fatal("dataset: got nil")
+	}
+	if !reflect.DeepEqual(got.DataSet.Columns, ds.Columns) || !reflect.DeepEqual(got.DataSet.Types, ds.Types) {
+		t.Errorf("got columns %q types %v", got.DataSet.Columns, got.DataSet.Types)
+	}
+	want := [][]interface{}{
+		{"'); DROP TABLE data; --", json.Number("-1"), json.Number("9223372036854775807"), "NaN"},
+		{nil, nil, nil, nil},
+	}
+	if !reflect.DeepEqual(got.DataSet.Rows, want) {
+		t.Errorf("rows: got %#v, want %#v", got.DataSet.Rows, want)
+	}
+}
+
+func TestArrayMetricRoundTrip(t *testing.T) {
+	_, b, err := encodeArray([]uint64{0, math.MaxUint64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := &sparkplug_b.Payload_Metric{
+		Name:     proto.String("counters"),
+		Datatype: proto.Uint32(29),
+		Value:    &sparkplug_b.Payload_Metric_BytesValue{BytesValue: b},
+	}
+
+	var got Metric
+	if err := got.Scan(toJSONB(t, *metricLiteral(metric))); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{json.Number("0"), json.Number("18446744073709551615")}
+	if !reflect.DeepEqual(got.Array, want) {
+		t.Errorf("array: got %#v, want %#v", got.Array, want)
+	}
+	if got.FormatValue() != "[0,18446744073709551615]" {
+		t.Errorf("FormatValue: got %q", got.FormatValue())
+	}
+
+	metric.Value = &sparkplug_b.Payload_Metric_BytesValue{BytesValue: []byte{1, 2, 3}}
+	if fields := parseComposite(t, *metricLiteral(metric)); fields[17] != nil {
+		t.Errorf("undecodable array: got %q, want NULL", *fields[17])
+	}
+}
+
+func TestIntegerBoundaries(t *testing.T) {
+	intValue := func(v uint32) *sparkplug_b.Payload_Metric {
+		return &sparkplug_b.Payload_Metric{Value: &sparkplug_b.Payload_Metric_IntValue{IntValue: v}}
+	}
+	longValue := func(v uint64) *sparkplug_b.Payload_Metric {
+		return &sparkplug_b.Payload_Metric{Value: &sparkplug_b.Payload_Metric_LongValue{LongValue: v}}
+	}
+	tests := []struct {
+		datatype uint32 // 0 if not set
+		metric   *sparkplug_b.Payload_Metric
+		column   int // field of metric_type: 11 value_int, 12 value_uint64, 18 value_long
+		want     string
+	}{
+		{1, intValue(uint32(0xffffff80)), 11, "-128"}, // Int8, sign-extended
+		{1, intValue(0x80), 11, "-128"},               // Int8, not sign-extended
+		{1, intValue(math.MaxInt8), 11, "127"},
+		{2, intValue(uint32(0xffff8000)), 11, "-32768"},
+		{2, intValue(math.MaxInt16), 11, "32767"},
+		{3, intValue(1 << 31), 11, "-2147483648"},
+		{3, intValue(math.MaxInt32), 11, "2147483647"},
+		{3, longValue(uint64(1<<64 - 1<<31)), 11, "-2147483648"},
+		{4, longValue(1 << 63), 18, "-9223372036854775808"},
+		{4, longValue(math.MaxInt64), 18, "9223372036854775807"},
+		{4, longValue(math.MaxUint64), 18, "-1"},
+		{5, intValue(0), 11, "0"},
+		{5, intValue(math.MaxUint8), 11, "255"},
+		{6, intValue(0), 11, "0"},
+		{6, intValue(math.MaxUint16), 11, "65535"},
+		{7, intValue(0), 18, "0"},
+		{7, intValue(1 << 31), 18, "2147483648"},
+		{7, intValue(math.MaxUint32), 18, "4294967295"},
+		{7, longValue(math.MaxUint32), 18, "4294967295"},
+		{8, longValue(0), 12, "0"},
+		{8, longValue(1 << 63), 12, "9223372036854775808"},
+		{8, longValue(math.MaxUint64), 12, "18446744073709551615"},
+		{13, longValue(1700000000123), 18, "2023-11-14T22:13:20.123Z"},
+		{0, intValue(math.MaxUint32), 18, "4294967295"},
+		{0, longValue(math.MaxUint64), 12, "18446744073709551615"},
+	}
+	for _, test := range tests {
+		test.metric.Name = proto.String("m")
+		if test.datatype != 0 {
+			test.metric.Datatype = proto.Uint32(test.datatype)
+		}
+		literal := *metricLiteral(test.metric)
+		fields := parseComposite(t, literal)
+		for _, column := range []int{11, 12, 18} {
+			if column == test.column && fields[column] == nil {
+				t.Errorf("%v %v: field %d is NULL", DataTypes[int(test.datatype)], test.want, column)
+			}
+			if column != test.column && fields[column] != nil {
+				t.Errorf("%v %v: unexpected field %d %q", DataTypes[int(test.datatype)], test.want, column, *fields[column])
+			}
+		}
+
+		var got Metric
+		if err := got.Scan(toJSONB(t, literal)); err != nil {
+			t.Fatalf("%v %v: %v", DataTypes[int(test.datatype)], test.want, err)
+		}
+		if got.FormatValue() != test.want {
+			t.Errorf("%v: stored %q, want %q", DataTypes[int(test.datatype)], got.FormatValue(), test.want)
+		}
+		if cached := metricFromPayload(test.metric); cached.FormatValue() != test.want {
+			t.Errorf("%v: cached %q, want %q", DataTypes[int(test.datatype)], cached.FormatValue(), test.want)
+		}
+	}
+}
+
+func TestPropertyIntegerBoundaries(t *testing.T) {
+	intValue := func(v uint32) *sparkplug_b.Payload_PropertyValue {
+		return &sparkplug_b.Payload_PropertyValue{Value: &sparkplug_b.Payload_PropertyValue_IntValue{IntValue: v}}
+	}
+	longValue := func(v uint64) *sparkplug_b.Payload_PropertyValue {
+		return &sparkplug_b.Payload_PropertyValue{Value: &sparkplug_b.Payload_PropertyValue_LongValue{LongValue: v}}
+	}
+	tests := []struct {
+		datatype uint32
+		value    *sparkplug_b.Payload_PropertyValue
+		column   int // field of propertyvalue_type: 2 int_value, 3 long_value, 10 uint64_value
+		want     string
+	}{
+		{1, intValue(uint32(0xffffff80)), 2, "-128"},
+		{3, intValue(1 << 31), 2, "-2147483648"},
+		{6, intValue(math.MaxUint16), 2, "65535"},
+		{7, intValue(1 << 31), 3, "2147483648"},
+		{7, intValue(math.MaxUint32), 3, "4294967295"},
+		{4, longValue(1 << 63), 3, "-9223372036854775808"},
+		{8, longValue(1 << 63), 10, "9223372036854775808"},
+		{8, longValue(math.MaxUint64), 10, "18446744073709551615"},
+		{13, longValue(1700000000123), 3, "2023-11-14T22:13:20.123Z"},
+	}
+	for _, test := range tests {
+		test.value.Type = proto.Uint32(test.datatype)
+		fields := parseComposite(t, *propertyValueLiteral(test.value))
+		for _, column := range []int{2, 3, 10} {
+			if (column == test.column) != (fields[column] != nil) {
+				t.Errorf("%v %v: field %d is %v", DataTypes[int(test.datatype)], test.want, column, fields[column])
+			}
+		}
+
+		// stored directly and nested in a property set, which is stored as JSON
+		metric := &sparkplug_b.Payload_Metric{Name: proto.String("m"), Properties: &sparkplug_b.Payload_PropertySet{
+			Keys: []string{"value", "nested"},
+			Values: []*sparkplug_b.Payload_PropertyValue{test.value, {Type: proto.Uint32(20),
+				Value: &sparkplug_b.Payload_PropertyValue_PropertysetValue{PropertysetValue: &sparkplug_b.Payload_PropertySet{
+					Keys: []string{"value"}, Values: []*sparkplug_b.Payload_PropertyValue{test.value}}}}},
+		}}
+		var got Metric
+		if err := got.Scan(toJSONB(t, *metricLiteral(metric))); err != nil {
+			t.Fatalf("%v %v: %v", DataTypes[int(test.datatype)], test.want, err)
+		}
+		if ps := got.Properties; ps == nil || len(ps.Values) != 2 || ps.Values[1].PropertySetValue == nil {
+			t.Fatalf("%v %v: got properties %+v", DataTypes[int(test.datatype)], test.want, ps)
+		}
+		if stored := got.Properties.Values[0].FormatValue(); stored != test.want {
+			t.Errorf("%v: stored %q, want %q", DataTypes[int(test.datatype)], stored, test.want)
+		}
+		if nested := got.Properties.Values[1].PropertySetValue.Values[0].FormatValue(); nested != test.want {
+			t.Errorf("%v: nested %q, want %q", DataTypes[int(test.datatype)], nested, test.want)
+		}
+	}
+}
+
+func TestMetadataIntegerBoundaries(t *testing.T) {
+	metric := &sparkplug_b.Payload_Metric{Name: proto.String("m"), Metadata: &sparkplug_b.Payload_MetaData{
+		Size: proto.Uint64(math.MaxUint64), Seq: proto.Uint64(1 << 63)}}
+	literal := *metricLiteral(metric)
+	md := parseComposite(t, *parseComposite(t, literal)[7])
+	if *md[2] != "18446744073709551615" || *md[3] != "9223372036854775808" {
+		t.Errorf("size, seq: got %q, %q", *md[2], *md[3])
+	}
+	var got Metric
+	if err := got.Scan(toJSONB(t, literal)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Metadata == nil || got.Metadata.Size != math.MaxUint64 || got.Metadata.Seq != 1<<63 {
+		t.Errorf("stored: got %+v", got.Metadata)
+	}
+	if cached := metricFromPayload(metric); cached.Metadata.Size != math.MaxUint64 || cached.Metadata.Seq != 1<<63 {
+		t.Errorf("cached: got %+v", cached.Metadata)
+	}
+}
+
+func TestDataCopyRow(t *testing.T) {
+	name := "'); DROP TABLE data; --\t\\"
+	item := ingestItem{
+		msg: &SparkplugMessage{
+			GroupId:     name,
+			MessageType: "NDATA",
+			EdgeNodeId:  "node\nwith newline",
+			Payload: &sparkplug_b.Payload{
+				Timestamp: proto.Uint64(1700000000123),
+				Seq:       proto.Uint64(3),
+				Metrics:   []*sparkplug_b.Payload_Metric{{Name: proto.String(name)}},
+			},
+		},
+		receivedAt: time.Unix(1700000000, 0),
+	}
+
+	var buffer bytes.Buffer
+	writeDataCopyRow(&buffer, item)
+	row := buffer.String()
+	if strings.Count(row, "\n") != 1 || !strings.HasSuffix(row, "\n") {
+		t.Fatalf("row must be terminated by a single newline: %q", row)
+	}
+	columns := strings.Split(strings.TrimSuffix(row, "\n"), "\t")
+	if len(columns) != strings.Count(copyDataQuery, ",")+1 {
+		t.Fatalf("got %d columns for query %q", len(columns), copyDataQuery)
+	}
+	if columns[0] != "DATA" {
+		t.Errorf("message_type: got %q, want DATA", columns[0])
+	}
+	if columns[2] != `'); DROP TABLE data; --\t\\` {
+		t.Errorf("group_id: got %q", columns[2])
+	}
+	if columns[3] != `node\nwith newline` {
+		t.Errorf("edge_node_id: got %q", columns[3])
+	}
+	if columns[5] != "2023-11-14T22:13:20.123Z" {
+		t.Errorf("timestamp: got %q", columns[5])
+	}
+	if columns[8] != `\N` {
+		t.Errorf("body: got %q, want NULL", columns[8])
+	}
+
+	args := sparkplugStateArgs(item)
+	if len(args) != strings.Count(updateSparkplugStateQuery, "$") {
+		t.Fatalf("got %d args for query %q", len(args), updateSparkplugStateQuery)
+	}
+	if args[0] != name {
+		t.Errorf("group id must be passed unchanged, got %v", args[0])
+	}
+
+	storeRawPayload = true
+	defer func() { storeRawPayload = false }()
+	item.body = []byte{0x08, 0xfb, 0x5c, 0x5c}
+	buffer.Reset()
+	writeDataCopyRow(&buffer, item)
+	if columns := strings.Split(buffer.String(), "\t"); columns[8] != `\\x08fb5c5c` {
+		t.Errorf("body: got %q", columns[8])
+	}
+}
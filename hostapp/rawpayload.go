@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+var (
+	storeRawPayload    bool
+	compressRawPayload bool
+)
+
+// gzipMagic starts every gzip stream. An encoded Sparkplug payload never starts
+// with it, as 0x1f would be field 3 with the unused wire type 7, so stored
+// bodies are recognized as compressed by their first bytes.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// rawPayloadBody returns the data.body of a message with the given encoded
+// payload, nil unless raw payloads are stored.
+func rawPayloadBody(data []byte) []byte {
+	if !storeRawPayload || data == nil {
+		return nil
+	}
+	if !compressRawPayload {
+		return data
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return data
+	}
+	if err := w.Close(); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// decodeRawPayloadBody returns the encoded payload stored in data.body,
+// decompressing it if it was stored compressed.
+func decodeRawPayloadBody(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, gzipMagic) {
+		return body, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"hostapp/sparkplug_b"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRawPayloadBody(t *testing.T) {
+	data, err := proto.Marshal(&sparkplug_b.Payload{
+		Timestamp: proto.Uint64(1700000000123),
+		Seq:       proto.Uint64(0),
+		Metrics:   []*sparkplug_b.Payload_Metric{{Name: proto.String("bdSeq"), Datatype: proto.Uint32(8)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { storeRawPayload, compressRawPayload = false, false }()
+
+	storeRawPayload, compressRawPayload = false, false
+	if body := rawPayloadBody(data); body != nil {
+		t.Errorf("not stored: got % x", body)
+	}
+
+	for _, compress := range []bool{false, true} {
+		storeRawPayload, compressRawPayload = true, compress
+		body := rawPayloadBody(data)
+		if compressed := bytes.HasPrefix(body, gzipMagic); compressed != compress {
+			t.Errorf("compress %v: body starts with % x", compress, body[:2])
+		}
+		got, err := decodeRawPayloadBody(body)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("compress %v: got % x, %v, want % x", compress, got, err, data)
+		}
+	}
+
+	if body := rawPayloadBody([]byte{}); body == nil {
+		t.Error("empty payload: got NULL, want an empty body")
+	}
+	if _, err := decodeRawPayloadBody(append(gzipMagic, 0x00)); err == nil {
+		t.Error("truncated gzip stream: expected an error")
+	}
+}
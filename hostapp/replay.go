@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/nats-io/nats.go"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// replayOptions are the arguments of the replay subcommand.
+type replayOptions struct {
+	From       time.Time
+	To         time.Time
+	GroupId    string // "" for all
+	EdgeNodeId string // "" for all
+	DeviceId   string // "" for all
+	NodeOnly   bool   // only messages of edge nodes, not of devices
+	Kinds      string // comma separated message_type values
+	Mode       string // replayPublish or replayIngest
+	Speed      float64
+	SourceURL  string
+}
+
+const (
+	replayPublish = "publish"
+	replayIngest  = "ingest"
+)
+
+// replayFilter selects the stored messages matching a replayOptions.
+const replayFilter = `
+	FROM data
+	WHERE received_at >= $1 AND received_at < $2
+	AND ($3 = '' OR group_id = $3)
+	AND ($4 = '' OR edge_node_id = $4)
+	AND ($5 = '' OR device_id = $5)
+	AND (NOT $7 OR COALESCE(device_id, '') = '')
+	AND message_type::text = ANY(string_to_array($6, ','))`
+
+// replayMessagesQuery reads the stored messages matching a replayOptions in the order they were received.
+const replayMessagesQuery = `
+	SELECT message_type::text, group_id, edge_node_id, COALESCE(device_id, ''), received_at, body` +
+	replayFilter + `
+	ORDER BY received_at`
+
+// replayCountQuery counts the stored messages matching a replayOptions.
+const replayCountQuery = `SELECT count(*)` + replayFilter
+
+// storedPayload is a message of the data table together with its raw payload.
+type storedPayload struct {
+	Kind       string
+	GroupId    string
+	EdgeNodeId string
+	DeviceId   string
+	ReceivedAt time.Time
+	Body       []byte
+}
+
+// parseReplayArgs parses the arguments following "replay" on the command line.
+func parseReplayArgs(args []string) (replayOptions, error) {
+	var opts replayOptions
+	var from, to string
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.StringVar(&from, "from", "", "Start of the range of received messages to replay (RFC 3339), required")
+	fs.StringVar(&to, "to", "", "End of the range, exclusive (RFC 3339), default now")
+	fs.StringVar(&opts.GroupId, "group", "", "Replay only messages of this group")
+	fs.StringVar(&opts.EdgeNodeId, "node", "", "Replay only messages of this edge node")
+	fs.StringVar(&opts.DeviceId, "device", "", "Replay only messages of this device, without those of its edge node")
+	fs.BoolVar(&opts.NodeOnly, "nodeOnly", false, "Replay only messages of edge nodes, without those of their devices")
+	fs.StringVar(&opts.Kinds, "types", "BIRTH,DEATH,DATA", "Comma separated message types to replay (BIRTH, DEATH, DATA, CMD)")
+	fs.StringVar(&opts.Mode, "mode", replayPublish, "publish: re-publish the messages to NATS, ingest: feed them into the ingestion of this process")
+	fs.Float64Var(&opts.Speed, "speed", 0, "publish mode: replay at this multiple of the original pace, 0 as fast as possible")
+	fs.StringVar(&opts.SourceURL, "source", "", "PostgreSQL URL to read the messages from, default -postgresURL")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	var err error
+	if from == "" {
+		return opts, errors.New("-from is required")
+	}
+	if opts.From, err = time.Parse(time.RFC3339Nano, from); err != nil {
+		return opts, fmt.Errorf("invalid -from: %w", err)
+	}
+	opts.To = time.Now()
+	if to != "" {
+		if opts.To, err = time.Parse(time.RFC3339Nano, to); err != nil {
+			return opts, fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	if opts.NodeOnly && opts.DeviceId != "" {
+		return opts, errors.New("-device and -nodeOnly exclude each other")
+	}
+	if !opts.From.Before(opts.To) {
+		return opts, errors.New("-from must be before -to")
+	}
+	for _, kind := range strings.Split(opts.Kinds, ",") {
+		if kind != "BIRTH" && kind != "DEATH" && kind != "DATA" && kind != "CMD" {
+			return opts, fmt.Errorf("invalid message type %q in -types", kind)
+		}
+	}
+	if opts.Mode != replayPublish && opts.Mode != replayIngest {
+		return opts, fmt.Errorf("-mode must be %v or %v", replayPublish, replayIngest)
+	}
+	if opts.Speed < 0 {
+		return opts, errors.New("-speed must not be negative")
+	}
+	return opts, nil
+}
+
+// runReplay implements "hostapp replay": it reads the messages stored with
+// -storeRawPayload from the data table and either re-publishes them on their
+// original NATS subjects or processes them like received messages, with their
+// original receive time, to rebuild the tables of the database given by
+// -postgresURL. Ingesting is refused if that database already has messages
+// matching the options, e.g. because it is the one they are read from.
+func runReplay(args []string) error {
+	opts, err := parseReplayArgs(args)
+	if err != nil {
+		return err
+	}
+	if opts.SourceURL == "" {
+		opts.SourceURL = postgresURL
+	}
+	source, err := sqlx.Connect("pgx", opts.SourceURL)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.Mode == replayIngest {
+		return replayIngestion(ctx, source, opts)
+	}
+	return replayPublishing(ctx, source, opts)
+}
+
+// replayPublishing publishes the stored messages to NATS, paced by opts.Speed.
+func replayPublishing(ctx context.Context, source *sqlx.DB, opts replayOptions) error {
+	nc, err := nats.Connect(natsBroker)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	start := time.Now()
+	var first time.Time
+	published := 0
+	err = readStoredPayloads(ctx, source, opts, func(p storedPayload) error {
+		if opts.Speed > 0 {
+			if first.IsZero() {
+				first = p.ReceivedAt
+			}
+			due := start.Add(time.Duration(float64(p.ReceivedAt.Sub(first)) / opts.Speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := nc.Publish(messageSubject(p.Kind, p.GroupId, p.EdgeNodeId, p.DeviceId), p.Body); err != nil {
+			return err
+		}
+		published++
+		return nil
+	})
+	if flushErr := nc.Flush(); err == nil {
+		err = flushErr
+	}
+	log.Printf("Published %d messages.\n", published)
+	return err
+}
+
+// replayIngestion processes the stored messages like received ones and writes
+// them to the database of -postgresURL.
+func replayIngestion(ctx context.Context, source *sqlx.DB, opts replayOptions) error {
+	err := connectDB(postgresURL)
+	if err != nil {
+		return err
+	}
+	defer disconnectDB()
+
+	var stored int64
+	err = db.QueryRowContext(ctx, replayCountQuery, replayArgs(opts)...).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if stored > 0 {
+		return fmt.Errorf("the target database already has %d of the messages to replay, they would be stored twice", stored)
+	}
+
+	for _, load := range []func() error{loadNodeSessions, loadSequences, loadAliasMaps, loadTemplateDefinitions} {
+		if err := load(); err != nil {
+			return err
+		}
+	}
+	// there are no edge nodes to ask for a rebirth
+	autoRebirth = false
+	// the rebuilt database keeps the payloads it is rebuilt from
+	storeRawPayload = true
+
+	var written, failed atomic.Int64
+	ack := func(err error) {
+		if err != nil {
+			failed.Add(1)
+			return
+		}
+		written.Add(1)
+	}
+
+	startIngestion()
+	err = readStoredPayloads(ctx, source, opts, func(p storedPayload) error {
+		subject := messageSubject(p.Kind, p.GroupId, p.EdgeNodeId, p.DeviceId)
+		if err := processSparkplugMessage(subject, p.Body, p.ReceivedAt, false, ack); err != nil {
+			log.Printf("Skipping %v received at %v: %v", subject, p.ReceivedAt, err)
+		}
+		return nil
+	})
+	stopIngestion()
+	log.Printf("Ingested %d messages, %d failed.\n", written.Load(), failed.Load())
+	if err == nil && failed.Load() > 0 {
+		err = fmt.Errorf("%d messages could not be written", failed.Load())
+	}
+	return err
+}
+
+// replayArgs returns the arguments of replayFilter.
+func replayArgs(opts replayOptions) []interface{} {
+	return []interface{}{opts.From, opts.To, opts.GroupId, opts.EdgeNodeId, opts.DeviceId, opts.Kinds, opts.NodeOnly}
+}
+
+// readStoredPayloads calls fn for every stored message matching opts, in the
+// order they were received. Messages stored without their raw payload are skipped.
+func readStoredPayloads(ctx context.Context, source *sqlx.DB, opts replayOptions, fn func(storedPayload) error) error {
+	rows, err := source.QueryContext(ctx, replayMessagesQuery, replayArgs(opts)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	skipped := 0
+	for rows.Next() {
+		var p storedPayload
+		if err := rows.Scan(&p.Kind, &p.GroupId, &p.EdgeNodeId, &p.DeviceId, &p.ReceivedAt, &p.Body); err != nil {
+			return err
+		}
+		if p.Body == nil {
+			skipped++
+			continue
+		}
+		if p.Body, err = decodeRawPayloadBody(p.Body); err != nil {
+			return fmt.Errorf("message of %v/%v/%v received at %v: %w", p.GroupId, p.EdgeNodeId, p.DeviceId, p.ReceivedAt, err)
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d messages stored without their raw payload.\n", skipped)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReplayArgs(t *testing.T) {
+	opts, err := parseReplayArgs([]string{"-from", "2023-11-14T22:00:00Z", "-to", "2023-11-15T00:00:00+01:00",
+		"-node", "node1", "-types", "BIRTH,DATA", "-mode", "ingest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.From.Equal(time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)) || opts.To.Sub(opts.From) != time.Hour {
+		t.Errorf("range: got %v - %v", opts.From, opts.To)
+	}
+	if opts.EdgeNodeId != "node1" || opts.GroupId != "" || opts.Kinds != "BIRTH,DATA" || opts.Mode != replayIngest {
+		t.Errorf("got %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-from", "yesterday"},
+		{"-from", "2023-11-14T22:00:00Z", "-to", "2023-11-14T22:00:00Z"},
+		{"-from", "2023-11-14T22:00:00Z", "-types", "BIRTH,STATE"},
+		{"-from", "2023-11-14T22:00:00Z", "-mode", "copy"},
+		{"-from", "2023-11-14T22:00:00Z", "-speed", "-1"},
+		{"-from", "2023-11-14T22:00:00Z", "extra"},
+		{"-from", "2023-11-14T22:00:00Z", "-device", "d", "-nodeOnly"},
+	} {
+		if _, err := parseReplayArgs(args); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestMessageSubject(t *testing.T) {
+	tests := []struct {
+		kind, group, node, device string
+		want                      string
+	}{
+		{"BIRTH", "g", "n", "", "spBv1//0.g.NBIRTH.n"},
+		{"DATA", "g", "n", "d", "spBv1//0.g.DDATA.n.d"},
+		{"CMD", "g", "n", "", "spBv1//0.g.NCMD.n"},
+	}
+	for _, test := range tests {
+		subject := messageSubject(test.kind, test.group, test.node, test.device)
+		if subject != test.want {
+			t.Errorf("got %q, want %q", subject, test.want)
+		}
+		msg, err := decodeSparkplugMessage(subject, nil)
+		if err != nil || msg.Kind() != test.kind || msg.GroupId != test.group || msg.EdgeNodeId != test.node || msg.DeviceId != test.device {
+			t.Errorf("%q decodes to %+v, %v", subject, msg, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	autoRebirth     bool
+	rebirthInterval time.Duration
+)
+
+// Sequence anomalies recorded in the sequence_event table.
+const (
+	seqGap             = "GAP"
+	seqDuplicate       = "DUPLICATE"
+	seqOutOfOrder      = "OUT_OF_ORDER"
+	seqDataBeforeBirth = "DATA_BEFORE_BIRTH"
+)
+
+// nodeSequence is the sequence number state of one edge node. The seq of
+// NBIRTH starts the session, every following DBIRTH, DDEATH, NDATA and DDATA
+// of the node must carry the next value (modulo 256).
+type nodeSequence struct {
+	born        bool
+	lastSeq     uint64
+	lastRebirth time.Time
+}
+
+type sequenceEvent struct {
+	Event       string
+	ExpectedSeq *uint64
+	Seq         *uint64
+	Rebirth     bool
+}
+
+var nodeSequences = map[string]*nodeSequence{}
+var nodeSequencesMutex sync.Mutex
+
+func nodeKey(groupId string, edgeNodeId string) string {
+	return groupId + "/" + edgeNodeId
+}
+
+// checkSequence updates the sequence state of the edge node of a message.
+// It returns nil if the message is in order, otherwise the detected anomaly.
+// A rebirth is only requested for a live message, not for one received earlier.
+func checkSequence(msg *SparkplugMessage, live bool) *sequenceEvent {
+	switch msg.MessageType {
+	case "NBIRTH", "NDEATH", "DBIRTH", "DDEATH", "NDATA", "DDATA":
+	default:
+		return nil
+	}
+
+	nodeSequencesMutex.Lock()
+	defer nodeSequencesMutex.Unlock()
+
+	key := nodeKey(msg.GroupId, msg.EdgeNodeId)
+	state, ok := nodeSequences[key]
+	if !ok {
+		state = &nodeSequence{}
+		nodeSequences[key] = state
+	}
+
+	switch msg.MessageType {
+	case "NBIRTH":
+		state.born = true
+		state.lastSeq = msg.Payload.GetSeq()
+		return nil
+	case "NDEATH":
+		state.born = false
+		return nil
+	}
+
+	seq := msg.Payload.Seq
+	if !state.born {
+		return &sequenceEvent{Event: seqDataBeforeBirth, Seq: seq, Rebirth: live && state.allowRebirth()}
+	}
+	if seq == nil {
+		return nil
+	}
+
+	expected := (state.lastSeq + 1) % 256
+	event := &sequenceEvent{ExpectedSeq: &expected, Seq: seq}
+	switch distance := (*seq + 256 - expected) % 256; {
+	case distance == 0:
+		state.lastSeq = *seq
+		return nil
+	case *seq == state.lastSeq:
+		event.Event = seqDuplicate
+	case distance < 128:
+		// messages were lost, continue counting from the received value
+		event.Event = seqGap
+		event.Rebirth = live && state.allowRebirth()
+		state.lastSeq = *seq
+	default:
+		event.Event = seqOutOfOrder
+	}
+	return event
+}
+
+// allowRebirth reports whether a rebirth may be requested now and, if so,
+// remembers the time, so a misbehaving node is asked at most once per rebirthInterval.
+func (s *nodeSequence) allowRebirth() bool {
+	if !autoRebirth || time.Since(s.lastRebirth) < rebirthInterval {
+		return false
+	}
+	s.lastRebirth = time.Now()
+	return true
+}
+
+// trackSequence checks the sequence number of a message, records anomalies
+// and, for a live message, requests a rebirth of the edge node if necessary.
+func trackSequence(msg *SparkplugMessage, receivedAt time.Time, live bool) {
+	event := checkSequence(msg, live)
+	if event == nil {
+		return
+	}
+	log.Printf("Sequence %v in %v from %v/%v/%v: expected %v, got %v", event.Event, msg.MessageType,
+		msg.GroupId, msg.EdgeNodeId, msg.DeviceId, formatSeq(event.ExpectedSeq), formatSeq(event.Seq))
+
+	if event.Rebirth {
+		err := publishRebirth(msg.GroupId, msg.EdgeNodeId)
+		if err != nil {
+			log.Printf("Error requesting rebirth: %v", err)
+			event.Rebirth = false
+		}
+	}
+	err := storeSequenceEventToDB(msg, event, receivedAt)
+	if err != nil {
+		log.Printf("Error saving sequence event to DB: %v", err)
+	}
+}
+
+// loadSequences restores the sequence state of the edge nodes that are online,
+// so their messages after a restart are not taken for data before birth.
+func loadSequences() error {
+	seqs, err := getLastSeqs()
+	if err != nil {
+		return err
+	}
+
+	nodeSequencesMutex.Lock()
+	defer nodeSequencesMutex.Unlock()
+	for key, seq := range seqs {
+		nodeSequences[key] = &nodeSequence{born: true, lastSeq: seq % 256}
+	}
+	log.Printf("Loaded sequence numbers of %d edge nodes.\n", len(seqs))
+	return nil
+}
+
+func formatSeq(seq *uint64) interface{} {
+	if seq == nil {
+		return "none"
+	}
+	return *seq
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// sequenceMessage is a message of edge node g/n, seq < 0 for none.
+func sequenceMessage(messageType string, seq int) *SparkplugMessage {
+	payload := &sparkplug_b.Payload{}
+	if seq >= 0 {
+		payload.Seq = proto.Uint64(uint64(seq))
+	}
+	msg := &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", MessageType: messageType, Payload: payload}
+	if messageType[0] == 'D' {
+		msg.DeviceId = "d"
+	}
+	return msg
+}
+
+func TestCheckSequence(t *testing.T) {
+	type step struct {
+		messageType string
+		seq         int
+		event       string // "" if in order
+		rebirth     bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{"NBIRTH", 0, "", false}, {"DBIRTH", 1, "", false}, {"NDATA", 2, "", false}, {"DDATA", 3, "", false}}},
+		{"wraparound", []step{{"NBIRTH", 254, "", false}, {"NDATA", 255, "", false}, {"NDATA", 0, "", false}, {"NDATA", 1, "", false}}},
+		{"birth resets", []step{{"NBIRTH", 0, "", false}, {"NDATA", 1, "", false}, {"NBIRTH", 100, "", false}, {"NDATA", 101, "", false}}},
+		{"duplicate", []step{{"NBIRTH", 0, "", false}, {"NDATA", 1, "", false}, {"NDATA", 1, seqDuplicate, false}, {"NDATA", 2, "", false}}},
+		{"duplicate at wraparound", []step{{"NBIRTH", 254, "", false}, {"NDATA", 255, "", false}, {"NDATA", 255, seqDuplicate, false}, {"NDATA", 0, "", false}}},
+		{"gap", []step{{"NBIRTH", 0, "", false}, {"NDATA", 1, "", false}, {"NDATA", 5, seqGap, true}, {"NDATA", 6, "", false}}},
+		{"gap across wraparound", []step{{"NBIRTH", 250, "", false}, {"NDATA", 3, seqGap, true}, {"NDATA", 4, "", false}}},
+		{"out of order", []step{{"NBIRTH", 0, "", false}, {"NDATA", 1, "", false}, {"NDATA", 2, "", false}, {"NDATA", 0, seqOutOfOrder, false}, {"NDATA", 3, "", false}}},
+		{"data before birth", []step{{"NDATA", 7, seqDataBeforeBirth, true}, {"DDATA", 8, seqDataBeforeBirth, false}, {"NBIRTH", 0, "", false}, {"NDATA", 1, "", false}}},
+		{"data after death", []step{{"NBIRTH", 0, "", false}, {"NDEATH", -1, "", false}, {"NDATA", 1, seqDataBeforeBirth, true}}},
+		{"no seq", []step{{"NBIRTH", 0, "", false}, {"NDATA", -1, "", false}, {"NDATA", 1, "", false}}},
+		{"rebirth rate limit", []step{{"NBIRTH", 0, "", false}, {"NDATA", 10, seqGap, true}, {"NDATA", 20, seqGap, false}, {"NDATA", 30, seqGap, false}}},
+		{"ignored message types", []step{{"NCMD", 42, "", false}, {"STATE", -1, "", false}}},
+	}
+
+	autoRebirth, rebirthInterval = true, time.Hour
+	defer func() { autoRebirth, rebirthInterval = false, 0 }()
+	for _, test := range tests {
+		nodeSequences = map[string]*nodeSequence{}
+		for i, step := range test.steps {
+			event := checkSequence(sequenceMessage(step.messageType, step.seq), true)
+			var got string
+			var rebirth bool
+			if event != nil {
+				got, rebirth = event.Event, event.Rebirth
+			}
+			if got != step.event || rebirth != step.rebirth {
+				t.Errorf("%s, step %d (%s %d): got event %q rebirth %v, want %q %v",
+					test.name, i, step.messageType, step.seq, got, rebirth, step.event, step.rebirth)
+			}
+		}
+	}
+}
+
+func TestAllowRebirth(t *testing.T) {
+	defer func() { autoRebirth, rebirthInterval = false, 0 }()
+
+	autoRebirth, rebirthInterval = false, 0
+	if (&nodeSequence{}).allowRebirth() {
+		t.Error("autoRebirth disabled: rebirth allowed")
+	}
+
+	autoRebirth, rebirthInterval = true, time.Hour
+	s := &nodeSequence{}
+	if !s.allowRebirth() {
+		t.Error("first rebirth not allowed")
+	}
+	if s.allowRebirth() {
+		t.Error("second rebirth within rebirthInterval allowed")
+	}
+	s.lastRebirth = time.Now().Add(-2 * time.Hour)
+	if !s.allowRebirth() {
+		t.Error("rebirth after rebirthInterval not allowed")
+	}
+}
+
+func TestSeededSequence(t *testing.T) {
+	nodeSequences = map[string]*nodeSequence{nodeKey("g", "n"): {born: true, lastSeq: 41}}
+	if event := checkSequence(sequenceMessage("NDATA", 42), true); event != nil {
+		t.Errorf("message following the seeded seq: got %+v", event)
+	}
+}
+
+func TestCheckSequenceBacklog(t *testing.T) {
+	autoRebirth, rebirthInterval = true, time.Hour
+	defer func() { autoRebirth, rebirthInterval = false, 0 }()
+	nodeSequences = map[string]*nodeSequence{}
+
+	for _, messageType := range []string{"NDATA", "NBIRTH"} {
+		if event := checkSequence(sequenceMessage(messageType, 0), false); messageType == "NDATA" && (event == nil || event.Rebirth) {
+			t.Errorf("data before birth in the backlog: got %+v, want no rebirth", event)
+		}
+	}
+	if event := checkSequence(sequenceMessage("NDATA", 10), false); event == nil || event.Event != seqGap || event.Rebirth {
+		t.Errorf("gap in the backlog: got %+v, want a gap without rebirth", event)
+	}
+	if event := checkSequence(sequenceMessage("NDATA", 20), true); event == nil || !event.Rebirth {
+		t.Errorf("live gap after a gap in the backlog: got %+v, want a rebirth", event)
+	}
+}
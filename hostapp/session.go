@@ -0,0 +1,292 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	staleTimeout       time.Duration
+	deviceStaleTimeout time.Duration
+	staleCheckInterval time.Duration
+)
+
+// nodeSession is the state of the current MQTT session of an edge node.
+type nodeSession struct {
+	bdSeq *uint64 // bdSeq metric of the last NBIRTH
+}
+
+var nodeSessions = map[string]*nodeSession{}
+var nodeSessionsMutex sync.Mutex
+
+// bdSeqOf returns the value of the bdSeq metric of an NBIRTH or NDEATH payload.
+func bdSeqOf(payload *sparkplug_b.Payload) *uint64 {
+	for _, metric := range payload.GetMetrics() {
+		if metric.GetName() != "bdSeq" {
+			continue
+		}
+		switch v := metric.GetValue().(type) {
+		case *sparkplug_b.Payload_Metric_LongValue:
+			return &v.LongValue
+		case *sparkplug_b.Payload_Metric_IntValue:
+			bdSeq := uint64(v.IntValue)
+			return &bdSeq
+		}
+	}
+	return nil
+}
+
+// checkSession remembers the bdSeq of an NBIRTH and reports whether an NDEATH
+// belongs to the current session of its edge node. An NDEATH with a different
+// bdSeq is a delayed will of an earlier session and must not mark the node offline.
+// All other messages are accepted.
+func checkSession(msg *SparkplugMessage) (accepted bool, expectedBdSeq *uint64) {
+	if msg.MessageType != "NBIRTH" && msg.MessageType != "NDEATH" {
+		return true, nil
+	}
+
+	nodeSessionsMutex.Lock()
+	defer nodeSessionsMutex.Unlock()
+
+	key := nodeKey(msg.GroupId, msg.EdgeNodeId)
+	session, ok := nodeSessions[key]
+	if !ok {
+		session = &nodeSession{}
+		nodeSessions[key] = session
+	}
+
+	bdSeq := bdSeqOf(msg.Payload)
+	if msg.MessageType == "NBIRTH" {
+		session.bdSeq = bdSeq
+		return true, nil
+	}
+	if bdSeq != nil && session.bdSeq != nil && *bdSeq != *session.bdSeq {
+		return false, session.bdSeq
+	}
+	return true, nil
+}
+
+// loadNodeSessions restores the bdSeq of every edge node from its last NBIRTH.
+func loadNodeSessions() error {
+	bdSeqs, err := getBirthBdSeqs()
+	if err != nil {
+		return err
+	}
+
+	nodeSessionsMutex.Lock()
+	defer nodeSessionsMutex.Unlock()
+	for key, bdSeq := range bdSeqs {
+		bdSeq := bdSeq
+		nodeSessions[key] = &nodeSession{bdSeq: &bdSeq}
+	}
+	log.Printf("Loaded bdSeq of %d edge nodes.\n", len(bdSeqs))
+	return nil
+}
+
+// activity is the time the last message of an online node or device was received.
+// A node or device that has been silent for longer than its timeout is stale:
+// it has not died, but it is likely that its NDEATH or DDEATH got lost.
+type activity struct {
+	groupId    string
+	edgeNodeId string
+	deviceId   string
+	lastSeen   time.Time
+	stale      bool
+}
+
+// staleEvent is a node or device that became stale or active again.
+type staleEvent struct {
+	GroupId    string
+	EdgeNodeId string
+	DeviceId   string
+	Event      string // STALE or ACTIVE
+	LastSeen   time.Time
+	DetectedAt time.Time
+}
+
+// activityTypes are the messages published by edge nodes and devices.
+var activityTypes = map[string]bool{
+	"NBIRTH": true, "NDATA": true, "NDEATH": true,
+	"DBIRTH": true, "DDATA": true, "DDEATH": true,
+}
+
+// activities holds the activity of every online node and device, keyed by deviceKey.
+var activities = map[string]*activity{}
+var activitiesMutex sync.Mutex
+
+var staleDone = make(chan struct{})
+var staleWG sync.WaitGroup
+
+// deleteNodeActivities forgets the devices of a node and, if withNode is set,
+// the node itself. The caller must hold activitiesMutex.
+func deleteNodeActivities(groupId string, edgeNodeId string, withNode bool) {
+	for key, a := range activities {
+		if a.groupId == groupId && a.edgeNodeId == edgeNodeId && (withNode || a.deviceId != "") {
+			delete(activities, key)
+		}
+	}
+}
+
+// touchActivity records a message of an online node or device at now and
+// returns an ACTIVE event if it was stale. The caller must hold activitiesMutex.
+func touchActivity(key string, now time.Time) *staleEvent {
+	a, ok := activities[key]
+	if !ok {
+		return nil
+	}
+	a.lastSeen = now
+	if !a.stale {
+		return nil
+	}
+	a.stale = false
+	return &staleEvent{GroupId: a.groupId, EdgeNodeId: a.edgeNodeId, DeviceId: a.deviceId,
+		Event: "ACTIVE", LastSeen: now, DetectedAt: now}
+}
+
+// trackActivity records the time of an accepted message and stores the
+// resulting ACTIVE events.
+func trackActivity(msg *SparkplugMessage, now time.Time) {
+	storeStaleEvents(updateActivity(msg, now))
+}
+
+// updateActivity records the time of an accepted message. A BIRTH makes its node
+// or device online, a DEATH offline; an NBIRTH or NDEATH also ends the sessions
+// of all devices of the node. Messages of a device also count for its node.
+// It returns an ACTIVE event for every node or device that was stale. Commands
+// are sent to the node, including the rebirth requests and writes of hostapp
+// itself, so they don't show that it is alive.
+func updateActivity(msg *SparkplugMessage, now time.Time) []*staleEvent {
+	if !activityTypes[msg.MessageType] {
+		return nil
+	}
+	key := deviceKey(msg.GroupId, msg.EdgeNodeId, msg.DeviceId)
+
+	activitiesMutex.Lock()
+	defer activitiesMutex.Unlock()
+	switch msg.MessageType {
+	case "NDEATH":
+		deleteNodeActivities(msg.GroupId, msg.EdgeNodeId, true)
+	case "DDEATH":
+		delete(activities, key)
+	case "NBIRTH":
+		deleteNodeActivities(msg.GroupId, msg.EdgeNodeId, false)
+		activities[key] = &activity{groupId: msg.GroupId, edgeNodeId: msg.EdgeNodeId, lastSeen: now}
+	case "DBIRTH":
+		activities[key] = &activity{groupId: msg.GroupId, edgeNodeId: msg.EdgeNodeId, deviceId: msg.DeviceId, lastSeen: now}
+	}
+
+	var events []*staleEvent
+	if event := touchActivity(deviceKey(msg.GroupId, msg.EdgeNodeId, ""), now); event != nil {
+		events = append(events, event)
+	}
+	if msg.DeviceId != "" {
+		if event := touchActivity(key, now); event != nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// isStale reports whether an online node or device has been silent for longer than its timeout.
+func isStale(groupId string, edgeNodeId string, deviceId string) bool {
+	activitiesMutex.Lock()
+	defer activitiesMutex.Unlock()
+	a, ok := activities[deviceKey(groupId, edgeNodeId, deviceId)]
+	return ok && a.stale
+}
+
+// checkStale stores the nodes and devices that became stale at now.
+func checkStale(now time.Time) {
+	storeStaleEvents(markStale(now))
+}
+
+// markStale marks the nodes and devices stale that have been silent for longer
+// than their timeout and returns a STALE event for each. A timeout of 0 disables the check.
+func markStale(now time.Time) []*staleEvent {
+	var events []*staleEvent
+	activitiesMutex.Lock()
+	defer activitiesMutex.Unlock()
+	for _, a := range activities {
+		timeout := staleTimeout
+		if a.deviceId != "" {
+			timeout = deviceStaleTimeout
+		}
+		if a.stale || timeout <= 0 || now.Sub(a.lastSeen) <= timeout {
+			continue
+		}
+		a.stale = true
+		events = append(events, &staleEvent{GroupId: a.groupId, EdgeNodeId: a.edgeNodeId, DeviceId: a.deviceId,
+			Event: "STALE", LastSeen: a.lastSeen, DetectedAt: now})
+	}
+	return events
+}
+
+func storeStaleEvents(events []*staleEvent) {
+	for _, event := range events {
+		log.Printf("%v/%v/%v is %v, last message received at %v", event.GroupId, event.EdgeNodeId, event.DeviceId,
+			event.Event, event.LastSeen.Format(time.RFC3339))
+		err := storeStaleEventToDB(event)
+		if err != nil {
+			log.Printf("Error saving stale event to DB: %v", err)
+		}
+	}
+}
+
+// loadActivities treats every node and device that is online in the database
+// as seen at startup, so it becomes stale if it stays silent.
+func loadActivities() error {
+	nodes, err := getNodes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	activitiesMutex.Lock()
+	defer activitiesMutex.Unlock()
+	for _, node := range nodes {
+		if node.State != nodeStateOnline {
+			continue
+		}
+		activities[deviceKey(node.GroupId, node.EdgeNodeId, node.DeviceId)] = &activity{
+			groupId:    node.GroupId,
+			edgeNodeId: node.EdgeNodeId,
+			deviceId:   node.DeviceId,
+			lastSeen:   now,
+		}
+	}
+	log.Printf("Tracking activity of %d online nodes and devices.\n", len(activities))
+	return nil
+}
+
+// startStaleDetection periodically checks for stale nodes and devices.
+func startStaleDetection() {
+	if staleTimeout <= 0 && deviceStaleTimeout <= 0 {
+		return
+	}
+	if staleCheckInterval <= 0 {
+		staleCheckInterval = time.Second
+	}
+	log.Printf("Detecting stale nodes after %v, devices after %v of silence.\n", staleTimeout, deviceStaleTimeout)
+	staleWG.Add(1)
+	go func() {
+		defer staleWG.Done()
+		ticker := time.NewTicker(staleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-staleDone:
+				return
+			case now := <-ticker.C:
+				checkStale(now)
+			}
+		}
+	}()
+}
+
+// stopStaleDetection stops the periodic check for stale nodes and devices.
+func stopStaleDetection() {
+	close(staleDone)
+	staleWG.Wait()
+}
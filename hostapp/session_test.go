@@ -0,0 +1,160 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStaleTransition(t *testing.T) {
+	defer func() {
+		activities = map[string]*activity{}
+		staleTimeout, deviceStaleTimeout = 0, 0
+	}()
+	activities = map[string]*activity{}
+	staleTimeout, deviceStaleTimeout = time.Minute, 2*time.Minute
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	message := func(messageType string, deviceId string) *SparkplugMessage {
+		return &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", DeviceId: deviceId, MessageType: messageType}
+	}
+	eventsOf := func(events []*staleEvent) []string {
+		var s []string
+		for _, event := range events {
+			s = append(s, event.DeviceId+":"+event.Event)
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	steps := []struct {
+		name   string
+		after  time.Duration
+		msg    *SparkplugMessage // nil for a check
+		events []string
+		staleN bool
+		staleD bool
+	}{
+		{"node birth", 0, message("NBIRTH", ""), nil, false, false},
+		{"device birth", 0, message("DBIRTH", "d"), nil, false, false},
+		{"within timeout", time.Minute, nil, nil, false, false},
+		{"node timeout", time.Minute + time.Second, nil, []string{":STALE"}, true, false},
+		{"still stale", 90 * time.Second, nil, nil, true, false},
+		{"device timeout", 2*time.Minute + time.Second, nil, []string{"d:STALE"}, true, true},
+		{"node data", 3 * time.Minute, message("NDATA", ""), []string{":ACTIVE"}, false, true},
+		{"device data", 3 * time.Minute, message("DDATA", "d"), []string{"d:ACTIVE"}, false, false},
+		{"both timeout", 6 * time.Minute, nil, []string{":STALE", "d:STALE"}, true, true},
+		{"device data revives node", 7 * time.Minute, message("DDATA", "d"), []string{":ACTIVE", "d:ACTIVE"}, false, false},
+		{"node stale again", 9*time.Minute + time.Second, nil, []string{":STALE", "d:STALE"}, true, true},
+		{"node command", 10 * time.Minute, message("NCMD", ""), nil, true, true},
+		{"device command", 10 * time.Minute, message("DCMD", "d"), nil, true, true},
+		{"command does not reset the timer", 10 * time.Minute, nil, nil, true, true},
+		{"node death", 10 * time.Minute, message("NDEATH", ""), nil, false, false},
+		{"offline is never stale", time.Hour, nil, nil, false, false},
+	}
+	for _, step := range steps {
+		now := start.Add(step.after)
+		var events []*staleEvent
+		if step.msg != nil {
+			events = updateActivity(step.msg, now)
+		} else {
+			events = markStale(now)
+		}
+		if got := eventsOf(events); strings.Join(got, ",") != strings.Join(step.events, ",") {
+			t.Errorf("%s: got events %v, want %v", step.name, got, step.events)
+		}
+		if stale := isStale("g", "n", ""); stale != step.staleN {
+			t.Errorf("%s: node stale %v, want %v", step.name, stale, step.staleN)
+		}
+		if stale := isStale("g", "n", "d"); stale != step.staleD {
+			t.Errorf("%s: device stale %v, want %v", step.name, stale, step.staleD)
+		}
+	}
+}
+
+func TestStaleDisabled(t *testing.T) {
+	defer func() { activities = map[string]*activity{} }()
+	activities = map[string]*activity{}
+	staleTimeout, deviceStaleTimeout = 0, 0
+	start := time.Now()
+	updateActivity(&SparkplugMessage{GroupId: "g", EdgeNodeId: "n", MessageType: "NBIRTH"}, start)
+	if events := markStale(start.Add(24 * time.Hour)); len(events) != 0 {
+		t.Errorf("timeout 0: got %d events", len(events))
+	}
+}
+
+// sessionMessage is an NBIRTH or NDEATH of edge node g/n, bdSeq < 0 for none.
+func sessionMessage(messageType string, bdSeq int) *SparkplugMessage {
+	payload := &sparkplug_b.Payload{}
+	if bdSeq >= 0 {
+		payload.Metrics = []*sparkplug_b.Payload_Metric{{Name: proto.String("bdSeq"), Datatype: proto.Uint32(8),
+			Value: &sparkplug_b.Payload_Metric_LongValue{LongValue: uint64(bdSeq)}}}
+	}
+	return &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", MessageType: messageType, Payload: payload}
+}
+
+func TestCheckSession(t *testing.T) {
+	type step struct {
+		messageType string
+		bdSeq       int
+		accepted    bool
+		expected    int // expected bdSeq of an ignored NDEATH
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"matching bdSeq", []step{{"NBIRTH", 3, true, 0}, {"NDEATH", 3, true, 0}}},
+		{"stale bdSeq", []step{{"NBIRTH", 3, true, 0}, {"NDEATH", 2, false, 3}, {"NDEATH", 3, true, 0}}},
+		{"rebirth", []step{{"NBIRTH", 3, true, 0}, {"NBIRTH", 4, true, 0}, {"NDEATH", 3, false, 4}, {"NDEATH", 4, true, 0}}},
+		{"death before birth", []step{{"NDEATH", 7, true, 0}, {"NBIRTH", 8, true, 0}, {"NDEATH", 8, true, 0}}},
+		{"death without bdSeq", []step{{"NBIRTH", 3, true, 0}, {"NDEATH", -1, true, 0}}},
+		{"birth without bdSeq", []step{{"NBIRTH", -1, true, 0}, {"NDEATH", 5, true, 0}}},
+		{"other messages", []step{{"NBIRTH", 3, true, 0}, {"NDATA", 2, true, 0}, {"DDEATH", 2, true, 0}}},
+	}
+	for _, test := range tests {
+		nodeSessions = map[string]*nodeSession{}
+		for i, step := range test.steps {
+			accepted, expected := checkSession(sessionMessage(step.messageType, step.bdSeq))
+			if accepted != step.accepted {
+				t.Errorf("%s, step %d (%s %d): got accepted %v", test.name, i, step.messageType, step.bdSeq, accepted)
+			}
+			if !accepted && (expected == nil || *expected != uint64(step.expected)) {
+				t.Errorf("%s, step %d: got expected bdSeq %v, want %d", test.name, i, formatSeq(expected), step.expected)
+			}
+		}
+	}
+	nodeSessions = map[string]*nodeSession{}
+}
+
+func TestIgnoredDeath(t *testing.T) {
+	queue := make(chan ingestItem, 2)
+	ingestQueues = []chan ingestItem{queue}
+	nodeSessions = map[string]*nodeSession{}
+	defer func() {
+		ingestQueues = nil
+		nodeSessions = map[string]*nodeSession{}
+		nodeSequences = map[string]*nodeSequence{}
+		activities = map[string]*activity{}
+	}()
+
+	for _, msg := range []*SparkplugMessage{sessionMessage("NBIRTH", 3), sessionMessage("NDEATH", 2)} {
+		data, err := proto.Marshal(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := messageSubject(msg.Kind(), msg.GroupId, msg.EdgeNodeId, "")
+		if err := processSparkplugMessage(subject, data, time.Now(), false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if birth := <-queue; birth.ignoredDeath {
+		t.Error("NBIRTH marked as ignored death")
+	}
+	if death := <-queue; !death.ignoredDeath || death.expectedBdSeq == nil || *death.expectedBdSeq != 3 {
+		t.Errorf("NDEATH of an earlier session: got ignoredDeath %v, expected bdSeq %v", death.ignoredDeath, formatSeq(death.expectedBdSeq))
+	}
+}
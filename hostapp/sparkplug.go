@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"google.golang.org/protobuf/proto"
 	"hostapp/sparkplug_b"
+	"math"
+	"reflect"
 	"strings"
+	"time"
 )
 
 type SparkplugMessage struct {
@@ -14,6 +20,8 @@ type SparkplugMessage struct {
 	EdgeNodeId  string
 	DeviceId    string
 	Payload     *sparkplug_b.Payload
+	HostId      string        // STATE messages only
+	State       *StatePayload // STATE messages only
 }
 
 var DataTypes = map[int]string{
@@ -54,11 +62,45 @@ var DataTypes = map[int]string{
 	34: "DateTimeArray",
 }
 
+// messageKinds maps the Sparkplug message types to the message_type enum of the database.
+var messageKinds = map[string]string{
+	"NBIRTH": "BIRTH",
+	"DBIRTH": "BIRTH",
+	"NDEATH": "DEATH",
+	"DDEATH": "DEATH",
+	"NDATA":  "DATA",
+	"DDATA":  "DATA",
+	"NCMD":   "CMD",
+	"DCMD":   "CMD",
+	"STATE":  "STATE",
+}
+
+// Kind returns the message_type of the message, e.g. BIRTH for NBIRTH and DBIRTH.
+func (m *SparkplugMessage) Kind() string {
+	return messageKinds[m.MessageType]
+}
+
+// messageSubject returns the NATS subject of a message of the given kind, e.g.
+// spBv1.0/<group>/NDATA/<node> for DATA or, if deviceId is set,
+// spBv1.0/<group>/DDATA/<node>/<device>.
+func messageSubject(kind string, groupId string, edgeNodeId string, deviceId string) string {
+	if deviceId == "" {
+		return "spBv1//0." + groupId + ".N" + kind + "." + edgeNodeId
+	}
+	return "spBv1//0." + groupId + ".D" + kind + "." + edgeNodeId + "." + deviceId
+}
+
 func decodeSparkplugMessage(subject string, data []byte) (*SparkplugMessage, error) {
 	parts := strings.Split(subject, ".")
+	if len(parts) == 3 && parts[1] == "STATE" {
+		return decodeStateMessage(parts, data)
+	}
 	if len(parts) < 4 {
 		return nil, errors.New("expected at least 4 parts in message subject")
 	}
+	if _, ok := messageKinds[parts[2]]; !ok || parts[2] == "STATE" {
+		return nil, fmt.Errorf("unknown message type %q", parts[2])
+	}
 
 	deviceId := ""
 	if len(parts) > 4 {
@@ -80,3 +122,459 @@ func decodeSparkplugMessage(subject string, data []byte) (*SparkplugMessage, err
 		Payload:     &payload,
 	}, nil
 }
+
+// decodeStateMessage decodes the JSON body of a spBv1.0/STATE/<host_id> message.
+func decodeStateMessage(parts []string, data []byte) (*SparkplugMessage, error) {
+	var state StatePayload
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STATE payload of host %v: %w", parts[2], err)
+	}
+	return &SparkplugMessage{
+		Namespace:   parts[0],
+		MessageType: "STATE",
+		HostId:      parts[2],
+		State:       &state,
+	}, nil
+}
+
+// millisTime converts a Sparkplug timestamp (milliseconds since epoch) to UTC time.
+func millisTime(millis *uint64) *time.Time {
+	if millis == nil {
+		return nil
+	}
+	t := time.UnixMilli(int64(*millis)).UTC()
+	return &t
+}
+
+// metricValue returns the value of a metric as the Go type matching its datatype,
+// nil if the metric is null or of a type without scalar value.
+func metricValue(metric *sparkplug_b.Payload_Metric) interface{} {
+	if metric.GetIsNull() {
+		return nil
+	}
+	switch v := metric.GetValue().(type) {
+	case *sparkplug_b.Payload_Metric_IntValue:
+		return intValue(metric.GetDatatype(), v.IntValue)
+	case *sparkplug_b.Payload_Metric_LongValue:
+		return longValue(metric.GetDatatype(), v.LongValue)
+	case *sparkplug_b.Payload_Metric_FloatValue:
+		return v.FloatValue
+	case *sparkplug_b.Payload_Metric_DoubleValue:
+		return v.DoubleValue
+	case *sparkplug_b.Payload_Metric_BooleanValue:
+		return v.BooleanValue
+	case *sparkplug_b.Payload_Metric_StringValue:
+		return v.StringValue
+	case *sparkplug_b.Payload_Metric_DatasetValue:
+		return decodeDataSet(v.DatasetValue)
+	case *sparkplug_b.Payload_Metric_TemplateValue:
+		return decodeTemplate(v.TemplateValue)
+	case *sparkplug_b.Payload_Metric_BytesValue:
+		if isArrayType(metric.GetDatatype()) {
+			array, err := decodeArray(metric.GetDatatype(), v.BytesValue)
+			if err != nil {
+				return nil
+			}
+			return jsonArray(array)
+		}
+	}
+	return nil
+}
+
+// intValue converts the int_value of a metric or DataSet cell according to its datatype.
+func intValue(datatype uint32, v uint32) interface{} {
+	switch datatype {
+	case 1: // Int8
+		return int8(v)
+	case 2: // Int16
+		return int16(v)
+	case 3: // Int32
+		return int32(v)
+	}
+	return v
+}
+
+// longValue converts the long_value of a metric or DataSet cell according to its datatype.
+func longValue(datatype uint32, v uint64) interface{} {
+	switch datatype {
+	case 4: // Int64
+		return int64(v)
+	case 7: // UInt32
+		return uint32(v)
+	case 13: // DateTime
+		return time.UnixMilli(int64(v)).UTC()
+	}
+	return v
+}
+
+// integerValue converts the raw int_value or long_value of an integer or DateTime
+// metric to the Metric field, and column of metric_type, matching its datatype:
+// ValueInt for Int8, Int16, Int32, UInt8 and UInt16, ValueLong for UInt32, Int64
+// and DateTime, ValueUint64 for UInt64. Without a known datatype, an int_value
+// is taken as UInt32 and a long_value as UInt64.
+func integerValue(datatype uint32, raw uint64, isLong bool) (valueInt *int32, valueLong *int64, valueUint64 *uint64) {
+	var i int32
+	var l int64
+	switch datatype {
+	case 1: // Int8
+		i = int32(int8(raw))
+	case 2: // Int16
+		i = int32(int16(raw))
+	case 3: // Int32
+		i = int32(raw)
+	case 5: // UInt8
+		i = int32(uint8(raw))
+	case 6: // UInt16
+		i = int32(uint16(raw))
+	case 7: // UInt32
+		l = int64(uint32(raw))
+		return nil, &l, nil
+	case 4, 13: // Int64, DateTime
+		l = int64(raw)
+		return nil, &l, nil
+	case 8: // UInt64
+		return nil, nil, &raw
+	default:
+		if isLong {
+			return nil, nil, &raw
+		}
+		l = int64(uint32(raw))
+		return nil, &l, nil
+	}
+	return &i, nil, nil
+}
+
+// decodeDataSet converts a DataSet to the table stored in value_dataset.
+// Cells without a value are nil, floats JSON cannot represent are replaced by their name.
+func decodeDataSet(ds *sparkplug_b.Payload_DataSet) *DataSet {
+	if ds == nil {
+		return nil
+	}
+	dataSet := &DataSet{
+		Columns: ds.GetColumns(),
+		Types:   ds.GetTypes(),
+		Rows:    make([][]interface{}, 0, len(ds.GetRows())),
+	}
+	if dataSet.Columns == nil {
+		dataSet.Columns = []string{}
+	}
+	if dataSet.Types == nil {
+		dataSet.Types = []uint32{}
+	}
+	for _, row := range ds.GetRows() {
+		cells := make([]interface{}, len(row.GetElements()))
+		for i, element := range row.GetElements() {
+			var datatype uint32
+			if i < len(dataSet.Types) {
+				datatype = dataSet.Types[i]
+			}
+			cells[i] = jsonValue(dataSetValue(datatype, element))
+		}
+		dataSet.Rows = append(dataSet.Rows, cells)
+	}
+	return dataSet
+}
+
+// decodeTemplate converts a template definition or instance to the description
+// stored in value_template: its parameters and the names and datatypes of its members.
+func decodeTemplate(t *sparkplug_b.Payload_Template) *Template {
+	if t == nil {
+		return nil
+	}
+	template := &Template{
+		Version:      t.GetVersion(),
+		TemplateRef:  t.GetTemplateRef(),
+		IsDefinition: t.GetIsDefinition(),
+		Parameters:   make([]TemplateParameter, 0, len(t.GetParameters())),
+		Members:      make([]TemplateMember, 0, len(t.GetMetrics())),
+	}
+	for _, p := range t.GetParameters() {
+		template.Parameters = append(template.Parameters, TemplateParameter{
+			Name:  p.GetName(),
+			Type:  p.GetType(),
+			Value: jsonValue(parameterValue(p)),
+		})
+	}
+	for _, m := range t.GetMetrics() {
+		template.Members = append(template.Members, TemplateMember{Name: m.GetName(), DataType: m.GetDatatype()})
+	}
+	return template
+}
+
+// parameterValue returns the value of a template parameter as the Go type matching its type.
+func parameterValue(p *sparkplug_b.Payload_Template_Parameter) interface{} {
+	switch v := p.GetValue().(type) {
+	case *sparkplug_b.Payload_Template_Parameter_IntValue:
+		return intValue(p.GetType(), v.IntValue)
+	case *sparkplug_b.Payload_Template_Parameter_LongValue:
+		return longValue(p.GetType(), v.LongValue)
+	case *sparkplug_b.Payload_Template_Parameter_FloatValue:
+		return v.FloatValue
+	case *sparkplug_b.Payload_Template_Parameter_DoubleValue:
+		return v.DoubleValue
+	case *sparkplug_b.Payload_Template_Parameter_BooleanValue:
+		return v.BooleanValue
+	case *sparkplug_b.Payload_Template_Parameter_StringValue:
+		return v.StringValue
+	}
+	return nil
+}
+
+// dataSetValue returns a DataSet cell as the Go type matching the datatype of its column.
+func dataSetValue(datatype uint32, value *sparkplug_b.Payload_DataSet_DataSetValue) interface{} {
+	switch v := value.GetValue().(type) {
+	case *sparkplug_b.Payload_DataSet_DataSetValue_IntValue:
+		return intValue(datatype, v.IntValue)
+	case *sparkplug_b.Payload_DataSet_DataSetValue_LongValue:
+		return longValue(datatype, v.LongValue)
+	case *sparkplug_b.Payload_DataSet_DataSetValue_FloatValue:
+		return v.FloatValue
+	case *sparkplug_b.Payload_DataSet_DataSetValue_DoubleValue:
+		return v.DoubleValue
+	case *sparkplug_b.Payload_DataSet_DataSetValue_BooleanValue:
+		return v.BooleanValue
+	case *sparkplug_b.Payload_DataSet_DataSetValue_StringValue:
+		return v.StringValue
+	}
+	return nil
+}
+
+// arrayElementSizes are the sizes in bytes of the elements of the fixed-width
+// array types, which are packed little-endian into bytes_value.
+var arrayElementSizes = map[uint32]int{
+	22: 1, // Int8Array
+	23: 2, // Int16Array
+	24: 4, // Int32Array
+	25: 8, // Int64Array
+	26: 1, // UInt8Array
+	27: 2, // UInt16Array
+	28: 4, // UInt32Array
+	29: 8, // UInt64Array
+	30: 4, // FloatArray
+	31: 8, // DoubleArray
+	34: 8, // DateTimeArray, milliseconds since epoch
+}
+
+func isArrayType(datatype uint32) bool {
+	return datatype >= 22 && datatype <= 34
+}
+
+// decodeArray decodes the bytes_value of an array metric into a slice of the
+// matching Go type ([]int8 ... []uint64, []float32, []float64, []bool, []string
+// or []time.Time). A BooleanArray is a little-endian uint32 count followed by
+// the values packed MSB first, a StringArray null-terminated UTF-8 strings.
+func decodeArray(datatype uint32, b []byte) (interface{}, error) {
+	switch datatype {
+	case 32:
+		return decodeBooleanArray(b)
+	case 33:
+		return decodeStringArray(b)
+	}
+	size, ok := arrayElementSizes[datatype]
+	if !ok {
+		return nil, fmt.Errorf("datatype %v is not an array type", datatype)
+	}
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("%v of %d bytes is not a multiple of %d bytes", DataTypes[int(datatype)], len(b), size)
+	}
+	n := len(b) / size
+	le := binary.LittleEndian
+	switch datatype {
+	case 22:
+		a := make([]int8, n)
+		for i := range a {
+			a[i] = int8(b[i])
+		}
+		return a, nil
+	case 23:
+		a := make([]int16, n)
+		for i := range a {
+			a[i] = int16(le.Uint16(b[2*i:]))
+		}
+		return a, nil
+	case 24:
+		a := make([]int32, n)
+		for i := range a {
+			a[i] = int32(le.Uint32(b[4*i:]))
+		}
+		return a, nil
+	case 25:
+		a := make([]int64, n)
+		for i := range a {
+			a[i] = int64(le.Uint64(b[8*i:]))
+		}
+		return a, nil
+	case 26:
+		a := make([]uint8, n)
+		copy(a, b)
+		return a, nil
+	case 27:
+		a := make([]uint16, n)
+		for i := range a {
+			a[i] = le.Uint16(b[2*i:])
+		}
+		return a, nil
+	case 28:
+		a := make([]uint32, n)
+		for i := range a {
+			a[i] = le.Uint32(b[4*i:])
+		}
+		return a, nil
+	case 29:
+		a := make([]uint64, n)
+		for i := range a {
+			a[i] = le.Uint64(b[8*i:])
+		}
+		return a, nil
+	case 30:
+		a := make([]float32, n)
+		for i := range a {
+			a[i] = math.Float32frombits(le.Uint32(b[4*i:]))
+		}
+		return a, nil
+	case 31:
+		a := make([]float64, n)
+		for i := range a {
+			a[i] = math.Float64frombits(le.Uint64(b[8*i:]))
+		}
+		return a, nil
+	default: // 34
+		a := make([]time.Time, n)
+		for i := range a {
+			a[i] = time.UnixMilli(int64(le.Uint64(b[8*i:]))).UTC()
+		}
+		return a, nil
+	}
+}
+
+func decodeBooleanArray(b []byte) ([]bool, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("BooleanArray of %d bytes has no count", len(b))
+	}
+	count := binary.LittleEndian.Uint32(b)
+	packed := b[4:]
+	if uint64(len(packed)) != (uint64(count)+7)/8 {
+		return nil, fmt.Errorf("BooleanArray of %d values needs %d bytes, got %d", count, (uint64(count)+7)/8, len(packed))
+	}
+	a := make([]bool, count)
+	for i := range a {
+		a[i] = packed[i/8]&(0x80>>(i%8)) != 0
+	}
+	return a, nil
+}
+
+func decodeStringArray(b []byte) ([]string, error) {
+	if len(b) == 0 {
+		return []string{}, nil
+	}
+	if b[len(b)-1] != 0 {
+		return nil, errors.New("StringArray is not null-terminated")
+	}
+	return strings.Split(string(b[:len(b)-1]), "\x00"), nil
+}
+
+// encodeArray is the inverse of decodeArray.
+func encodeArray(value interface{}) (datatype uint32, b []byte, err error) {
+	le := binary.LittleEndian
+	switch a := value.(type) {
+	case []int8:
+		b = make([]byte, len(a))
+		for i, v := range a {
+			b[i] = byte(v)
+		}
+		return 22, b, nil
+	case []int16:
+		b = make([]byte, 2*len(a))
+		for i, v := range a {
+			le.PutUint16(b[2*i:], uint16(v))
+		}
+		return 23, b, nil
+	case []int32:
+		b = make([]byte, 4*len(a))
+		for i, v := range a {
+			le.PutUint32(b[4*i:], uint32(v))
+		}
+		return 24, b, nil
+	case []int64:
+		b = make([]byte, 8*len(a))
+		for i, v := range a {
+			le.PutUint64(b[8*i:], uint64(v))
+		}
+		return 25, b, nil
+	case []uint8:
+		b = make([]byte, len(a))
+		copy(b, a)
+		return 26, b, nil
+	case []uint16:
+		b = make([]byte, 2*len(a))
+		for i, v := range a {
+			le.PutUint16(b[2*i:], v)
+		}
+		return 27, b, nil
+	case []uint32:
+		b = make([]byte, 4*len(a))
+		for i, v := range a {
+			le.PutUint32(b[4*i:], v)
+		}
+		return 28, b, nil
+	case []uint64:
+		b = make([]byte, 8*len(a))
+		for i, v := range a {
+			le.PutUint64(b[8*i:], v)
+		}
+		return 29, b, nil
+	case []float32:
+		b = make([]byte, 4*len(a))
+		for i, v := range a {
+			le.PutUint32(b[4*i:], math.Float32bits(v))
+		}
+		return 30, b, nil
+	case []float64:
+		b = make([]byte, 8*len(a))
+		for i, v := range a {
+			le.PutUint64(b[8*i:], math.Float64bits(v))
+		}
+		return 31, b, nil
+	case []bool:
+		b = make([]byte, 4+(len(a)+7)/8)
+		le.PutUint32(b, uint32(len(a)))
+		for i, v := range a {
+			if v {
+				b[4+i/8] |= 0x80 >> (i % 8)
+			}
+		}
+		return 32, b, nil
+	case []string:
+		for _, v := range a {
+			if strings.IndexByte(v, 0) >= 0 {
+				return 0, nil, fmt.Errorf("StringArray element %q contains a null byte", v)
+			}
+			b = append(b, v...)
+			b = append(b, 0)
+		}
+		return 33, b, nil
+	case []time.Time:
+		b = make([]byte, 8*len(a))
+		for i, v := range a {
+			le.PutUint64(b[8*i:], uint64(v.UnixMilli()))
+		}
+		return 34, b, nil
+	}
+	return 0, nil, fmt.Errorf("cannot encode %T as a Sparkplug array", value)
+}
+
+// jsonArray converts a decoded array to the elements stored in value_array.
+// Unlike the slice itself, a []uint8 is not encoded as base64, and floats
+// JSON cannot represent are replaced by their name.
+func jsonArray(array interface{}) []interface{} {
+	v := reflect.ValueOf(array)
+	if v.Kind() != reflect.Slice {
+		return nil
+	}
+	elements := make([]interface{}, v.Len())
+	for i := range elements {
+		elements[i] = jsonValue(v.Index(i).Interface())
+	}
+	return elements
+}
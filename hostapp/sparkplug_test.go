@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArrayRoundTrip(t *testing.T) {
+	arrays := map[uint32]interface{}{
+		22: []int8{0, 1, -1, math.MinInt8, math.MaxInt8},
+		23: []int16{0, 1, -1, math.MinInt16, math.MaxInt16},
+		24: []int32{0, 1, -1, math.MinInt32, math.MaxInt32},
+		25: []int64{0, 1, -1, math.MinInt64, math.MaxInt64},
+		26: []uint8{0, 1, math.MaxUint8},
+		27: []uint16{0, 1, math.MaxUint16},
+		28: []uint32{0, 1, math.MaxUint32},
+		29: []uint64{0, 1, math.MaxUint64},
+		30: []float32{0, 1.5, -2.25, math.MaxFloat32, math.SmallestNonzeroFloat32, float32(math.Inf(-1))},
+		31: []float64{0, 1.5, -2.25, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1)},
+		32: []bool{true, false, true, true, false, false, false, true, true},
+		33: []string{"", "a", "Grüße, 温度", "comma, \"quote\""},
+		34: []time.Time{time.UnixMilli(0).UTC(), time.UnixMilli(1700000000123).UTC(), time.UnixMilli(-1).UTC()},
+	}
+	for datatype := uint32(22); datatype <= 34; datatype++ {
+		want, ok := arrays[datatype]
+		if !ok {
+			t.Fatalf("no test array for %v", DataTypes[int(datatype)])
+		}
+		gotType, b, err := encodeArray(want)
+		if err != nil {
+			t.Fatalf("%v: %v", DataTypes[int(datatype)], err)
+		}
+		if gotType != datatype {
+			t.Errorf("%v: encoded as datatype %v", DataTypes[int(datatype)], gotType)
+		}
+		got, err := decodeArray(datatype, b)
+		if err != nil {
+			t.Fatalf("%v: %v", DataTypes[int(datatype)], err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", DataTypes[int(datatype)], got, want)
+		}
+
+		empty := reflect.MakeSlice(reflect.TypeOf(want), 0, 0).Interface()
+		_, b, err = encodeArray(empty)
+		if err != nil {
+			t.Fatalf("%v: %v", DataTypes[int(datatype)], err)
+		}
+		got, err = decodeArray(datatype, b)
+		if err != nil || reflect.ValueOf(got).Len() != 0 {
+			t.Errorf("%v: empty array: got %v, %v", DataTypes[int(datatype)], got, err)
+		}
+	}
+}
+
+func TestArrayNaN(t *testing.T) {
+	_, b, _ := encodeArray([]float64{math.NaN()})
+	got, err := decodeArray(31, b)
+	if err != nil || !math.IsNaN(got.([]float64)[0]) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if elements := jsonArray(got); elements[0] != "NaN" {
+		t.Errorf("json element: got %v, want NaN", elements[0])
+	}
+}
+
+func TestArrayLittleEndian(t *testing.T) {
+	got, err := decodeArray(28, []byte{0x01, 0x02, 0x03, 0x04, 0xff, 0xff, 0xff, 0xff})
+	if err != nil || !reflect.DeepEqual(got, []uint32{0x04030201, math.MaxUint32}) {
+		t.Errorf("UInt32Array: got %v, %v", got, err)
+	}
+	got, err = decodeArray(23, []byte{0xfe, 0xff})
+	if err != nil || !reflect.DeepEqual(got, []int16{-2}) {
+		t.Errorf("Int16Array: got %v, %v", got, err)
+	}
+}
+
+func TestBooleanArrayPacking(t *testing.T) {
+	// example of the Sparkplug 3.0 specification: a uint32 count followed by MSB-first bits
+	values := []bool{false, false, true, true, false, true, false, false, true, true, false, true}
+	packed := []byte{0x0c, 0x00, 0x00, 0x00, 0x34, 0xd0}
+
+	_, b, err := encodeArray(values)
+	if err != nil || !bytes.Equal(b, packed) {
+		t.Errorf("encode: got % x, %v, want % x", b, err, packed)
+	}
+	got, err := decodeArray(32, packed)
+	if err != nil || !reflect.DeepEqual(got, values) {
+		t.Errorf("decode: got %v, %v, want %v", got, err, values)
+	}
+
+	for _, invalid := range [][]byte{{}, {0x01, 0x00, 0x00}, {0x09, 0x00, 0x00, 0x00, 0xff}, {0x01, 0x00, 0x00, 0x00}} {
+		if _, err := decodeArray(32, invalid); err == nil {
+			t.Errorf("decode % x: expected an error", invalid)
+		}
+	}
+}
+
+func TestStringArrayTerminators(t *testing.T) {
+	packed := []byte("ABC\x00hello\x00\x00")
+	want := []string{"ABC", "hello", ""}
+
+	_, b, err := encodeArray(want)
+	if err != nil || !bytes.Equal(b, packed) {
+		t.Errorf("encode: got %q, %v, want %q", b, err, packed)
+	}
+	got, err := decodeArray(33, packed)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("decode: got %q, %v, want %q", got, err, want)
+	}
+
+	if _, err := decodeArray(33, []byte("ABC\x00unterminated")); err == nil {
+		t.Error("decode of an unterminated string: expected an error")
+	}
+	if _, _, err := encodeArray([]string{"null\x00byte"}); err == nil {
+		t.Error("encode of a string with a null byte: expected an error")
+	}
+}
+
+func TestArrayInvalidLength(t *testing.T) {
+	for datatype, size := range arrayElementSizes {
+		if size == 1 {
+			continue
+		}
+		if _, err := decodeArray(datatype, make([]byte, size+1)); err == nil {
+			t.Errorf("%v of %d bytes: expected an error", DataTypes[int(datatype)], size+1)
+		}
+	}
+	if _, err := decodeArray(12, nil); err == nil {
+		t.Error("String is not an array type: expected an error")
+	}
+}
+
+func TestDecodeUnknownMessageType(t *testing.T) {
+	for _, subject := range []string{"spBv1//0.g.NFOO.n", "spBv1//0.g.STATE.n", "spBv1//0.g.ndata.n"} {
+		if msg, err := decodeSparkplugMessage(subject, nil); err == nil {
+			t.Errorf("%v: got %+v, expected an error", subject, msg)
+		}
+	}
+	if _, err := decodeSparkplugMessage("spBv1//0.g.NDATA.n", nil); err != nil {
+		t.Errorf("NDATA: %v", err)
+	}
+}
+
+func TestDecodeStateMessage(t *testing.T) {
+	tests := []struct {
+		subject string
+		body    string
+		want    *StatePayload // nil for an error
+	}{
+		{"spBv1//0.STATE.h", `{"online":true,"timestamp":1700000000123}`, &StatePayload{Online: true, Timestamp: 1700000000123}},
+		{"spBv1//0.STATE.h", `{"online":false,"timestamp":5}`, &StatePayload{Online: false, Timestamp: 5}},
+		{"spBv1//0.STATE.h", `{"timestamp":5}`, &StatePayload{Online: false, Timestamp: 5}},
+		{"spBv1//0.STATE.h", `{"online":true,`, nil},
+		{"spBv1//0.STATE.h", `{"online":"yes","timestamp":5}`, nil},
+		{"spBv1//0.STATE.h", "\x08\x01", nil},
+		{"spBv1//0.STATE.h", "", nil},
+		{"spBv1//0.STATE", `{"online":true,"timestamp":5}`, nil},
+		{"spBv1//0.STATE.h.x", `{"online":true,"timestamp":5}`, nil},
+	}
+	for _, test := range tests {
+		msg, err := decodeSparkplugMessage(test.subject, []byte(test.body))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %q: got %+v, expected an error", test.subject, test.body, msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", test.subject, test.body, err)
+			continue
+		}
+		if msg.Namespace != "spBv1//0" || msg.Kind() != "STATE" || msg.HostId != "h" || msg.Payload != nil || *msg.State != *test.want {
+			t.Errorf("%s %q: got %+v with state %+v, want host h with state %+v", test.subject, test.body, msg, msg.State, test.want)
+		}
+	}
+}
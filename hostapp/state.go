@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"time"
+)
+
+var (
+	hostId     string
+	mqttBroker string
+)
+
+// The STATE messages are published over MQTT rather than NATS, as only MQTT
+// supports retained messages and a will that is published by the broker when
+// hostapp disappears without a clean shutdown.
+var mqttClient mqtt.Client
+
+// stateTimestamp is the timestamp of the STATE birth and death of this session.
+// Sparkplug 3.0 requires the will to carry the same timestamp as the birth.
+var stateTimestamp int64
+
+// StatePayload is the JSON body of spBv1.0/STATE/<host_id> messages.
+type StatePayload struct {
+	Online    bool  `json:"online"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+func stateTopic() string {
+	return "spBv1.0/STATE/" + hostId
+}
+
+func statePayload(online bool) []byte {
+	payload, _ := json.Marshal(StatePayload{Online: online, Timestamp: stateTimestamp})
+	return payload
+}
+
+// connectState connects to the MQTT broker with the STATE death as will and
+// publishes the retained STATE birth of this Primary Host Application.
+func connectState() error {
+	if hostId == "" {
+		return errors.New("host ID must not be empty")
+	}
+	stateTimestamp = time.Now().UnixMilli()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(mqttBroker).
+		SetClientID("hostapp-"+hostId).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetBinaryWill(stateTopic(), statePayload(false), 1, true).
+		SetOnConnectHandler(onStateConnect)
+
+	log.Printf("Connecting to MQTT on URL %v as host %v.\n", mqttBroker, hostId)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(30 * time.Second) {
+		return fmt.Errorf("timeout connecting to MQTT broker %v", mqttBroker)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	mqttClient = client
+	return nil
+}
+
+// onStateConnect runs on every (re)connect. It watches the own STATE topic,
+// so a stale will of this host published by the broker is overwritten, and
+// publishes the STATE birth. paho runs it in its own goroutine, but message
+// handlers run in the goroutine that also completes the tokens of the client,
+// so the handler must not wait for the publish to complete.
+func onStateConnect(client mqtt.Client) {
+	token := client.Subscribe(stateTopic(), 1, func(client mqtt.Client, msg mqtt.Message) {
+		var state StatePayload
+		if err := json.Unmarshal(msg.Payload(), &state); err != nil || state.Online {
+			return
+		}
+		log.Printf("Received offline STATE for own host %v, publishing STATE birth again.", hostId)
+		go publishState(client, true)
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error subscribing to %v: %v", stateTopic(), token.Error())
+	}
+	publishState(client, true)
+}
+
+func publishState(client mqtt.Client, online bool) {
+	token := client.Publish(stateTopic(), 1, true, statePayload(online))
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error publishing STATE to %v: %v", stateTopic(), token.Error())
+		return
+	}
+	log.Printf("Published STATE online=%v for host %v.\n", online, hostId)
+}
+
+// disconnectState publishes the retained STATE death and disconnects cleanly.
+func disconnectState() {
+	if mqttClient == nil {
+		return
+	}
+	mqttClient.Unsubscribe(stateTopic()).Wait()
+	publishState(mqttClient, false)
+	mqttClient.Disconnect(1000)
+}
@@ -0,0 +1,162 @@
+(function (window, document) {
+
+    // Updates the value and last update time of the metrics on the node page
+    // from the Server-Sent Events of the hostapp API.
+    var table = document.getElementById('metrics');
+    if (!table || !window.EventSource) {
+        return;
+    }
+
+    function rowsByMetric() {
+        var rows = {};
+        var elements = table.querySelectorAll('tr[data-metric]');
+        for (var i = 0; i < elements.length; i++) {
+            rows[elements[i].getAttribute('data-metric')] = elements[i];
+        }
+        return rows;
+    }
+
+    // The names of the Sparkplug datatypes, as DataTypes of the hostapp.
+    var dataTypeNames = ['Unknown', 'Int8', 'Int16', 'Int32', 'Int64', 'UInt8', 'UInt16', 'UInt32', 'UInt64',
+        'Float', 'Double', 'Boolean', 'String', 'DateTime', 'Text', 'UUID', 'DataSet', 'Bytes', 'File',
+        'TemplateRegistry', 'PropertySet', 'PropertySetList', 'Int8Array', 'Int16Array', 'Int32Array',
+        'Int64Array', 'UInt8Array', 'UInt16Array', 'UInt32Array', 'UInt64Array', 'FloatArray', 'DoubleArray',
+        'BooleanArray', 'StringArray', 'DateTimeArray'];
+
+    function dataTypeName(dataType) {
+        return dataTypeNames[dataType] || String(dataType);
+    }
+
+    // formatFloat formats a number like strconv.FormatFloat(v, 'g', -1, 64):
+    // the shortest representation, with an exponent below 1e-4 and from 1e6.
+    function formatFloat(v) {
+        var parts = v.toExponential().split('e');
+        var exp = parseInt(parts[1], 10);
+        if (exp < -4 || exp >= 6) {
+            var digits = String(Math.abs(exp));
+            return parts[0] + 'e' + (exp < 0 ? '-' : '+') + (digits.length < 2 ? '0' : '') + digits;
+        }
+        return String(v);
+    }
+
+    // formatScalar formats a value of the given datatype like the web UI does.
+    // 64-bit integers arrive as strings, the floats JSON cannot represent as their name.
+    function formatScalar(value, dataType) {
+        if (value === null || value === undefined) {
+            return '';
+        }
+        if (typeof value === 'number' && (dataType === 9 || dataType === 10)) {
+            return formatFloat(value);
+        }
+        return String(value);
+    }
+
+    // formatArray formats an array like its JSON, with the 64-bit integers
+    // of Int64Array and UInt64Array as numbers.
+    function formatArray(array, dataType) {
+        var int64 = dataType === 25 || dataType === 29;
+        var elements = [];
+        for (var i = 0; i < array.length; i++) {
+            elements.push(int64 ? array[i] : JSON.stringify(array[i]));
+        }
+        return '[' + elements.join(',') + ']';
+    }
+
+    // formatValue formats the value of a metric like Metric.FormatValue.
+    function formatValue(update) {
+        if (update.isNull || update.value === null || update.value === undefined) {
+            return '';
+        }
+        if (Array.isArray(update.value)) {
+            return formatArray(update.value, update.dataType);
+        }
+        return formatScalar(update.value, update.dataType);
+    }
+
+    // renderDataSet replaces the content of a cell by the table of a DataSet value.
+    function renderDataSet(cell, dataSet) {
+        var t = document.createElement('table');
+        t.className = 'dataset';
+        var header = t.insertRow();
+        for (var i = 0; i < dataSet.columns.length; i++) {
+            var th = document.createElement('th');
+            th.textContent = dataSet.columns[i];
+            header.appendChild(th);
+        }
+        for (var r = 0; r < dataSet.rows.length; r++) {
+            var tr = t.insertRow();
+            for (var c = 0; c < dataSet.rows[r].length; c++) {
+                tr.insertCell().textContent = formatScalar(dataSet.rows[r][c], dataSet.types[c]);
+            }
+        }
+        cell.textContent = '';
+        cell.appendChild(t);
+    }
+
+    // renderTemplate replaces the content of a cell by the description of a
+    // Template value, as the "template" block of the node page.
+    function renderTemplate(cell, template) {
+        var div = document.createElement('div');
+        div.className = 'template';
+        var title = template.isDefinition ? 'Template definition' : 'Instance of ' + (template.templateRef || '');
+        if (template.version) {
+            title += ' (version ' + template.version + ')';
+        }
+        div.appendChild(document.createTextNode(title));
+        if (template.parameters.length > 0) {
+            var t = document.createElement('table');
+            t.className = 'template-parameters';
+            var header = t.insertRow();
+            var names = ['Parameter', 'Type', 'Value'];
+            for (var i = 0; i < names.length; i++) {
+                var th = document.createElement('th');
+                th.textContent = names[i];
+                header.appendChild(th);
+            }
+            for (var p = 0; p < template.parameters.length; p++) {
+                var parameter = template.parameters[p];
+                var tr = t.insertRow();
+                tr.insertCell().textContent = parameter.name;
+                tr.insertCell().textContent = dataTypeName(parameter.type);
+                tr.insertCell().textContent = formatScalar(parameter.value, parameter.type);
+            }
+            div.appendChild(t);
+        }
+        if (template.members.length > 0) {
+            var members = [];
+            for (var m = 0; m < template.members.length; m++) {
+                members.push(template.members[m].name);
+            }
+            var list = document.createElement('div');
+            list.textContent = 'Members: ' + members.join(', ');
+            div.appendChild(list);
+        }
+        cell.textContent = '';
+        cell.appendChild(div);
+    }
+
+    var rows = rowsByMetric();
+    var source = new EventSource(table.getAttribute('data-live-url'));
+
+    source.addEventListener('metrics', function (e) {
+        var updates = JSON.parse(e.data);
+        for (var i = 0; i < updates.length; i++) {
+            var update = updates[i];
+            var row = rows[update.name];
+            if (!row) {
+                continue;
+            }
+            var cell = row.querySelector('.metric-value');
+            if (update.value && update.value.columns && update.value.rows) {
+                renderDataSet(cell, update.value);
+            } else if (update.value && update.value.parameters && update.value.members) {
+                renderTemplate(cell, update.value);
+            } else {
+                cell.textContent = formatValue(update);
+            }
+            row.querySelector('.metric-updated').textContent =
+                new Date(update.timestamp || update.receivedAt).toLocaleString();
+        }
+    });
+
+}(this, this.document));
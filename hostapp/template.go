@@ -0,0 +1,124 @@
+package main
+
+import (
+	"google.golang.org/protobuf/proto"
+	"hostapp/sparkplug_b"
+	"log"
+	"sync"
+)
+
+// templateDefinitions holds the template definitions of the last NBIRTH of every
+// edge node, keyed by nodeKey and template name.
+var templateDefinitions = map[string]map[string]*Template{}
+var templateDefinitionsMutex sync.RWMutex
+
+// memberType returns the datatype of a member of a template definition, 0 if unknown.
+func (t *Template) memberType(name string) uint32 {
+	if t == nil {
+		return 0
+	}
+	for _, member := range t.Members {
+		if member.Name == name {
+			return member.DataType
+		}
+	}
+	return 0
+}
+
+// registerTemplateDefinitions replaces the template definitions of an edge node
+// by those of its NBIRTH.
+func registerTemplateDefinitions(msg *SparkplugMessage) {
+	definitions := make(map[string]*Template)
+	for _, metric := range msg.Payload.Metrics {
+		t := metric.GetTemplateValue()
+		if t == nil || !t.GetIsDefinition() || metric.Name == nil {
+			continue
+		}
+		definitions[*metric.Name] = decodeTemplate(t)
+	}
+
+	templateDefinitionsMutex.Lock()
+	defer templateDefinitionsMutex.Unlock()
+	templateDefinitions[nodeKey(msg.GroupId, msg.EdgeNodeId)] = definitions
+}
+
+// expandTemplates registers the template definitions of an NBIRTH and appends
+// the members of every template instance of a BIRTH or DATA message as metrics
+// of their own, named "instance/member" (nested instances "a/b/member"), so they
+// are stored and can be queried like any other metric. Members without a
+// datatype get the one of their template definition, also in the instance.
+func expandTemplates(msg *SparkplugMessage) {
+	if msg.Payload == nil {
+		return
+	}
+	if msg.MessageType == "NBIRTH" {
+		registerTemplateDefinitions(msg)
+	}
+	kind := msg.Kind()
+	if kind != "BIRTH" && kind != "DATA" {
+		return
+	}
+
+	templateDefinitionsMutex.RLock()
+	definitions := templateDefinitions[nodeKey(msg.GroupId, msg.EdgeNodeId)]
+	templateDefinitionsMutex.RUnlock()
+
+	var members []*sparkplug_b.Payload_Metric
+	for _, metric := range msg.Payload.Metrics {
+		t := metric.GetTemplateValue()
+		if t == nil || t.GetIsDefinition() || metric.Name == nil {
+			continue
+		}
+		members = append(members, flattenTemplate(*metric.Name, metric, t, definitions)...)
+	}
+	msg.Payload.Metrics = append(msg.Payload.Metrics, members...)
+}
+
+func flattenTemplate(prefix string, instance *sparkplug_b.Payload_Metric, t *sparkplug_b.Payload_Template,
+	definitions map[string]*Template) []*sparkplug_b.Payload_Metric {
+	definition := definitions[t.GetTemplateRef()]
+	var members []*sparkplug_b.Payload_Metric
+	for _, member := range t.GetMetrics() {
+		if member.Name == nil {
+			continue
+		}
+		if member.Datatype == nil {
+			if datatype := definition.memberType(member.GetName()); datatype != 0 {
+				member.Datatype = proto.Uint32(datatype)
+			}
+		}
+		flat := proto.Clone(member).(*sparkplug_b.Payload_Metric)
+		flat.Name = proto.String(prefix + "/" + member.GetName())
+		flat.Alias = nil
+		if flat.Timestamp == nil {
+			flat.Timestamp = instance.Timestamp
+		}
+		members = append(members, flat)
+		if nested := flat.GetTemplateValue(); nested != nil && !nested.GetIsDefinition() {
+			members = append(members, flattenTemplate(flat.GetName(), flat, nested, definitions)...)
+		}
+	}
+	return members
+}
+
+// loadTemplateDefinitions restores the template definitions from the birth table.
+func loadTemplateDefinitions() error {
+	definitions, err := getTemplateDefinitions()
+	if err != nil {
+		return err
+	}
+
+	templateDefinitionsMutex.Lock()
+	defer templateDefinitionsMutex.Unlock()
+	for i := range definitions {
+		key := nodeKey(definitions[i].GroupId, definitions[i].EdgeNodeId)
+		nodeDefinitions, ok := templateDefinitions[key]
+		if !ok {
+			nodeDefinitions = make(map[string]*Template)
+			templateDefinitions[key] = nodeDefinitions
+		}
+		nodeDefinitions[definitions[i].Name] = &definitions[i].Template
+	}
+	log.Printf("Loaded %d template definitions.\n", len(definitions))
+	return nil
+}
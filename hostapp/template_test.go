@@ -0,0 +1,105 @@
+package main
+
+import (
+	"hostapp/sparkplug_b"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// templateMetric is a metric holding a template definition or instance.
+func templateMetric(name string, ref string, isDefinition bool, members ...*sparkplug_b.Payload_Metric) *sparkplug_b.Payload_Metric {
+	t := &sparkplug_b.Payload_Template{Metrics: members, IsDefinition: proto.Bool(isDefinition)}
+	if ref != "" {
+		t.TemplateRef = proto.String(ref)
+	}
+	metric := &sparkplug_b.Payload_Metric{Datatype: proto.Uint32(19), Value: &sparkplug_b.Payload_Metric_TemplateValue{TemplateValue: t}}
+	if name != "" {
+		metric.Name = proto.String(name)
+	}
+	return metric
+}
+
+// memberMetric is a template member with the given datatype, 0 for none.
+func memberMetric(name string, datatype uint32) *sparkplug_b.Payload_Metric {
+	metric := &sparkplug_b.Payload_Metric{}
+	if name != "" {
+		metric.Name = proto.String(name)
+	}
+	if datatype != 0 {
+		metric.Datatype = proto.Uint32(datatype)
+	}
+	return metric
+}
+
+func TestExpandTemplates(t *testing.T) {
+	defer func() {
+		templateDefinitionsMutex.Lock()
+		delete(templateDefinitions, nodeKey("g", "n"))
+		templateDefinitionsMutex.Unlock()
+	}()
+	message := func(messageType string, deviceId string, metrics ...*sparkplug_b.Payload_Metric) *SparkplugMessage {
+		return &SparkplugMessage{GroupId: "g", EdgeNodeId: "n", DeviceId: deviceId, MessageType: messageType,
+			Payload: &sparkplug_b.Payload{Metrics: metrics}}
+	}
+	motor := func(name string, timestamp uint64) *sparkplug_b.Payload_Metric {
+		speed := memberMetric("speed", 0)
+		speed.Alias = proto.Uint64(7)
+		state := memberMetric("state", 12)
+		state.Timestamp = proto.Uint64(50)
+		instance := templateMetric(name, "Motor", false, speed, state, memberMetric("", 3),
+			templateMetric("bearing", "Bearing", false, memberMetric("temp", 0)))
+		instance.Timestamp = proto.Uint64(timestamp)
+		return instance
+	}
+	type want struct {
+		name      string
+		datatype  uint32
+		timestamp uint64
+	}
+
+	tests := []struct {
+		name string
+		msg  *SparkplugMessage
+		want []want
+	}{
+		{"node birth", message("NBIRTH", "",
+			templateMetric("Motor", "", true, memberMetric("speed", 3), memberMetric("state", 12),
+				templateMetric("bearing", "Bearing", false, memberMetric("temp", 10))),
+			templateMetric("Bearing", "", true, memberMetric("temp", 10)),
+			motor("m1", 100)),
+			[]want{{"m1/speed", 3, 100}, {"m1/state", 12, 50}, {"m1/bearing", 19, 100}, {"m1/bearing/temp", 10, 100}}},
+		{"device data", message("DDATA", "d", motor("m2", 200)),
+			[]want{{"m2/speed", 3, 200}, {"m2/state", 12, 50}, {"m2/bearing", 19, 200}, {"m2/bearing/temp", 10, 200}}},
+		{"missing definition", message("NDATA", "", templateMetric("x", "Pump", false, memberMetric("flow", 0), memberMetric("on", 11))),
+			[]want{{"x/flow", 0, 0}, {"x/on", 11, 0}}},
+		{"instance without name", message("NDATA", "", templateMetric("", "Bearing", false, memberMetric("temp", 0))), nil},
+		{"death", message("NDEATH", "", motor("m3", 300)), nil},
+	}
+	for _, test := range tests {
+		before := len(test.msg.Payload.Metrics)
+		expandTemplates(test.msg)
+		got := test.msg.Payload.Metrics[before:]
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %d members, want %d", test.name, len(got), len(test.want))
+			continue
+		}
+		for i, m := range got {
+			w := test.want[i]
+			if m.GetName() != w.name || m.GetDatatype() != w.datatype || m.GetTimestamp() != w.timestamp || m.Alias != nil {
+				t.Errorf("%s: got member %s of type %d at %d with alias %v, want %s of type %d at %d",
+					test.name, m.GetName(), m.GetDatatype(), m.GetTimestamp(), m.Alias, w.name, w.datatype, w.timestamp)
+			}
+		}
+	}
+}
+
+func TestExpandTemplatesFillsInstance(t *testing.T) {
+	definitions := map[string]*Template{"Motor": {Members: []TemplateMember{{Name: "speed", DataType: 3}}}}
+	instance := templateMetric("m", "Motor", false, memberMetric("speed", 0), memberMetric("other", 0))
+	flattenTemplate("m", instance, instance.GetTemplateValue(), definitions)
+	members := instance.GetTemplateValue().GetMetrics()
+	if members[0].GetDatatype() != 3 || members[1].Datatype != nil {
+		t.Errorf("got instance member types %v, %v, want 3, none", members[0].Datatype, members[1].Datatype)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"hostapp/sparkplug_b"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +22,31 @@ func isOlder(date1, date2 time.Time) bool {
 	return date1.Before(date2)
 }
 
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+func dataTypeName(dataType uint32) string {
+	if name, ok := DataTypes[int(dataType)]; ok {
+		return name
+	}
+	return fmt.Sprint(dataType)
+}
+
+func formatPercent(p *float64) string {
+	if p == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f %%", *p)
+}
+
+// csrfFormField is the form field carrying the CSRF token, stored in the echo
+// context under csrfContextKey.
+const (
+	csrfFormField  = "_csrf"
+	csrfContextKey = "csrf"
+)
+
 // TemplateRegistry is a custom template renderer for echo
 type TemplateRegistry struct {
 	templates map[string]*template.Template
@@ -42,6 +73,16 @@ func serveNodeList(c echo.Context) error {
 	return err
 }
 
+func serveHostList(c echo.Context) error {
+	hosts, err := getHosts()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Cannot fetch host applications")
+	}
+	return c.Render(http.StatusOK, "hosts.html", hosts)
+}
+
+// serveNodeInfo renders the node page. The query parameters "notice" and
+// "error" carry the outcome of a command, see serveNodeCommand.
 func serveNodeInfo(c echo.Context) error {
 	groupId := c.Param("groupId")
 	nodeId := c.Param("nodeId")
@@ -50,23 +91,123 @@ func serveNodeInfo(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Cannot fetch device")
 	}
+	return renderNodeInfo(c, http.StatusOK, node, c.QueryParam("notice"), c.QueryParam("error"))
+}
+
+// nodePagePath returns the path of the node page of a node or device.
+func nodePagePath(groupId string, nodeId string, deviceId string) string {
+	nodePath := url.PathEscape(groupId) + "/" + url.PathEscape(nodeId)
+	if deviceId != "" {
+		nodePath += "/" + url.PathEscape(deviceId)
+	}
+	return nodePath
+}
+
+// renderNodeInfo renders the node page, optionally with the outcome of a command.
+// The session timeline covers the window given by the query parameter "window".
+func renderNodeInfo(c echo.Context, code int, node *NodeInfo, notice string, cmdError string) error {
+	nodePath := nodePagePath(node.GroupId, node.EdgeNodeId, node.DeviceId)
+	window := c.QueryParam("window")
+	windowDuration := time.Duration(0)
+	for _, w := range sessionWindows {
+		if w.Name == window {
+			windowDuration = w.Duration
+		}
+	}
+	if windowDuration == 0 {
+		window, windowDuration = defaultSessionWindow, 24*time.Hour
+	}
+	to := time.Now()
+	from := to.Add(-windowDuration)
+	events, err := getSessionHistory(node.GroupId, node.EdgeNodeId, node.DeviceId, from, to)
+	if err != nil {
+		c.Logger().Error(err)
+	}
+	csrfToken, _ := c.Get(csrfContextKey).(string)
+
 	data := struct {
-		Node      *NodeInfo
-		DataTypes map[int]string
+		Node         *NodeInfo
+		DataTypes    map[int]string
+		CmdURL       string
+		CSRFToken    string
+		LiveURL      string
+		Current      map[string]*MetricValue
+		Availability Availability
+		Windows      interface{}
+		Window       string
+		Notice       string
+		Error        string
 	}{
-		Node:      node,
-		DataTypes: DataTypes,
+		Node:         node,
+		Current:      getLKVByName(node.GroupId, node.EdgeNodeId, node.DeviceId),
+		DataTypes:    DataTypes,
+		CmdURL:       "/node/" + nodePath + "/cmd",
+		CSRFToken:    csrfToken,
+		LiveURL:      "/api/v1" + apiNodePath(node.GroupId, node.EdgeNodeId, node.DeviceId) + "/live",
+		Availability: computeAvailability(events, from, to),
+		Windows:      sessionWindows,
+		Window:       window,
+		Notice:       notice,
+		Error:        cmdError,
 	}
-	return c.Render(http.StatusOK, "node.html", data)
+	return c.Render(code, "node.html", data)
+}
+
+// serveNodeCommand publishes an NCMD or DCMD that writes the submitted value
+// to a metric of the last birth of the node or device. It redirects to the
+// node page with the outcome, so reloading the page does not send the command again.
+func serveNodeCommand(c echo.Context) error {
+	groupId := c.Param("groupId")
+	nodeId := c.Param("nodeId")
+	deviceId := c.Param("deviceId")
+	node, err := getNodeInfo(groupId, nodeId, deviceId)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Cannot fetch device")
+	}
+	redirect := func(key string, message string) error {
+		query := url.Values{key: {message}}
+		return c.Redirect(http.StatusSeeOther, "/node/"+nodePagePath(groupId, nodeId, deviceId)+"?"+query.Encode())
+	}
+
+	name := c.FormValue("name")
+	var metric *Metric
+	for i := range node.Metrics {
+		if node.Metrics[i].Name == name {
+			metric = &node.Metrics[i]
+			break
+		}
+	}
+	if metric == nil {
+		return redirect("error", fmt.Sprintf("Unknown metric %q", name))
+	}
+
+	cmd, err := commandMetric(*metric, c.FormValue("value"))
+	if err != nil {
+		return redirect("error", err.Error())
+	}
+	err = publishCommand(groupId, nodeId, deviceId, []*sparkplug_b.Payload_Metric{cmd})
+	if err != nil {
+		c.Logger().Error(err)
+		return redirect("error", "Cannot publish command: "+err.Error())
+	}
+	return redirect("notice", fmt.Sprintf("Sent %q to metric %q", c.FormValue("value"), name))
 }
 
 func customHTTPErrorHandler(err error, c echo.Context) {
 	code := http.StatusInternalServerError
+	message := http.StatusText(code)
 	var he *echo.HTTPError
 	if errors.As(err, &he) {
 		code = he.Code
+		message = fmt.Sprint(he.Message)
 	}
 	c.Logger().Error(err)
+	if isAPIRequest(c) {
+		if err := apiError(c, code, message); err != nil {
+			c.Logger().Error(err)
+		}
+		return
+	}
 	errorPage := fmt.Sprintf("%d.html", code)
 	if err := c.File(errorPage); err != nil {
 		c.Logger().Error(err)
@@ -79,12 +220,25 @@ func startWebUI() {
 
 	e.HTTPErrorHandler = customHTTPErrorHandler
 
+	// Protect the forms of the web UI, which send commands to the edge nodes
+	e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        isAPIRequest,
+		TokenLookup:    "form:" + csrfFormField,
+		ContextKey:     csrfContextKey,
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteStrictMode,
+	}))
+
 	// Set up static file handling
 	e.Static("/static", "static")
 
 	// Set up templates
 	funcMap := template.FuncMap{
-		"isOlder": isOlder,
+		"isOlder":       isOlder,
+		"isTrue":        isTrue,
+		"formatPercent": formatPercent,
+		"dataTypeName":  dataTypeName,
 	}
 	templates := make(map[string]*template.Template)
 
@@ -109,10 +263,29 @@ func startWebUI() {
 
 	// Define routes
 	e.GET("/", serveNodeList)
+	e.GET("/hosts", serveHostList)
 	e.GET("/node/:groupId/:nodeId", serveNodeInfo)
 	e.GET("/node/:groupId/:nodeId/:deviceId", serveNodeInfo)
+	e.POST("/node/:groupId/:nodeId/cmd", serveNodeCommand)
+	e.POST("/node/:groupId/:nodeId/:deviceId/cmd", serveNodeCommand)
+	registerAPIRoutes(e)
 
 	// Start http server
-	e.Logger.Fatal(e.Start(":8080"))
+	go func() {
+		err := e.Start(":8080")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
 
+	// Wait for an interrupt and shut the server down gracefully
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	stopLiveUpdates()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Error(err)
+	}
 }
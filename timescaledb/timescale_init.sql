@@ -14,8 +14,9 @@ CREATE TYPE message_type AS ENUM (
 CREATE TYPE metadata_type AS (
     is_multi_part BOOLEAN,
     content_type TEXT,
-    size BIGINT,
-    seq BIGINT,
+    -- unsigned 64-bit, NUMERIC as BIGINT cannot hold values above 2^63-1
+    size NUMERIC(20, 0),
+    seq NUMERIC(20, 0),
     file_name TEXT,
     file_type TEXT,
     md5 TEXT,
@@ -25,16 +26,20 @@ CREATE TYPE metadata_type AS (
 CREATE TYPE propertyvalue_type AS (
     "type" INT,
     is_null BOOLEAN,
+    -- Int8, Int16, Int32, UInt8 and UInt16
     int_value INT,
+    -- UInt32, Int64 and DateTime (milliseconds since epoch)
     long_value BIGINT,
     float_value FLOAT,
     double_value DOUBLE PRECISION,
     boolean_value BOOLEAN,
-    string_value TEXT
-    --- TODO figure out how to handle circular reference
-    --- propertyset_value propertyset_type,
-    --- propertyset_list propertyset_type[]
-
+    string_value TEXT,
+    -- PropertySet and PropertySetList as the JSON of a propertyset_type and an
+    -- array of those, as a composite type cannot contain itself
+    propertyset_value JSONB,
+    propertysets_value JSONB,
+    -- UInt64, NUMERIC as BIGINT cannot hold values above 2^63-1
+    uint64_value NUMERIC(20, 0)
     );
 
 CREATE TYPE propertyset_type AS (
@@ -55,10 +60,21 @@ CREATE TYPE metric_type AS (
     properties propertyset_type,
     value_string TEXT,
     value_bool BOOLEAN,
+    -- Int8, Int16, Int32, UInt8 and UInt16
     value_int INTEGER,
-    value_uint64 BIGINT,
+    -- UInt64, NUMERIC as BIGINT cannot hold values above 2^63-1
+    value_uint64 NUMERIC(20, 0),
     value_double DOUBLE PRECISION,
-    value_float REAL
+    value_float REAL,
+    -- DataSet as {"columns": [...], "types": [...], "rows": [[...], ...]}
+    value_dataset JSONB,
+    -- Template definition or instance with its parameters and members; the
+    -- values of instance members are stored as separate "instance/member" metrics
+    value_template JSONB,
+    -- elements of Int8Array ... DateTimeArray decoded from bytes_value
+    value_array JSONB,
+    -- UInt32, Int64 and DateTime (milliseconds since epoch)
+    value_long BIGINT
     );
 
 
@@ -115,41 +131,115 @@ create table public.death
 );
 
 
-CREATE OR REPLACE PROCEDURE insert_sparkplug_payload(
+-- NDEATH messages ignored by hostapp because their bdSeq did not match the
+-- bdSeq of the current NBIRTH, e.g. a delayed will of an earlier session
+create table public.ignored_death
+(
+    group_id TEXT NOT NULL,
+    edge_node_id TEXT NOT NULL,
+    device_id TEXT NULL,
+    timestamp TIMESTAMPTZ NULL,
+    bd_seq BIGINT NULL,
+    expected_bd_seq BIGINT NULL,
+    received_at TIMESTAMPTZ NOT NULL
+);
+
+SELECT create_hypertable('ignored_death', 'received_at');
+
+
+-- Sequence number anomalies detected by hostapp
+create table public.sequence_event
+(
+    group_id TEXT NOT NULL,
+    edge_node_id TEXT NOT NULL,
+    device_id TEXT NULL,
+    message_type TEXT NOT NULL,
+    event TEXT NOT NULL,
+    expected_seq BIGINT NULL,
+    seq BIGINT NULL,
+    rebirth_requested BOOLEAN NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL
+);
+
+SELECT create_hypertable('sequence_event', 'received_at');
+
+
+-- Every state transition of the nodes and devices: BIRTH and DEATH, UNKNOWN for
+-- the online devices of a node that sent a new NBIRTH, and STALE and ACTIVE for
+-- online nodes and devices that have been silent for longer than the stale
+-- timeout of hostapp and that sent a message again
+create table public.session_history
+(
+    group_id TEXT NOT NULL,
+    edge_node_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL
+);
+
+SELECT create_hypertable('session_history', 'received_at');
+CREATE INDEX ON session_history (group_id, edge_node_id, device_id, received_at DESC);
+
+
+-- Latest STATE of every Sparkplug host application
+create table public.host_state
+(
+    host_id TEXT NOT NULL,
+    online BOOLEAN NOT NULL,
+    timestamp TIMESTAMPTZ NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT unique_state_per_host UNIQUE (host_id)
+);
+
+
+-- Updates birth, death and metrics_info for a message that has already been
+-- written to the data table. Called by insert_sparkplug_payload and by the
+-- batched ingestion of hostapp, which writes the data rows with COPY.
+CREATE OR REPLACE PROCEDURE update_sparkplug_state(
     p_group_id TEXT,
-    p_message_type TEXT,
+    p_message_type message_type,
     p_edge_node_id TEXT,
     p_device_id TEXT,
     p_timestamp TIMESTAMPTZ,
-    p_seq BIGINT,
-    p_uuid TEXT,
-    p_body bytea,
-    p_metrics metric_type[]
+    p_metrics metric_type[],
+    p_received_at TIMESTAMPTZ
 )
     LANGUAGE plpgsql
 AS $$
 DECLARE
-    msg_type message_type;
-    received_ts TIMESTAMPTZ := now();
     metric metric_type;
 BEGIN
-    msg_type := CASE
-            WHEN p_message_type='DDATA' or p_message_type='NDATA' THEN 'DATA'::message_type
-            WHEN p_message_type='DBIRTH' or p_message_type='NBIRTH' THEN 'BIRTH'::message_type
-            WHEN p_message_type='DDEATH' or p_message_type='NDEATH' THEN 'DEATH'::message_type
-            WHEN p_message_type='DCMD' or p_message_type='NCMD' THEN 'CMD'::message_type
-            WHEN p_message_type='STATE' THEN 'STATE'::message_type
-    END;
-        -- store whole payload plus topic to data table --
-    INSERT INTO data
-        (message_type, received_at, group_id, edge_node_id, device_id, timestamp, seq, uuid, body, metrics)
-    VALUES
-        (msg_type, received_ts, p_group_id, p_edge_node_id, p_device_id, p_timestamp, p_seq, p_uuid, p_body, p_metrics);
+    IF p_message_type='BIRTH' THEN
+
+        -- the online devices of a node are unknown after an NBIRTH until their own DBIRTH
+        IF p_device_id='' THEN
+            INSERT INTO session_history
+            (group_id, edge_node_id, device_id, event, received_at)
+            SELECT b.group_id, b.edge_node_id, b.device_id, 'UNKNOWN', p_received_at
+            FROM birth AS b
+                JOIN birth AS nb
+                    ON nb.group_id=b.group_id
+                    AND nb.edge_node_id=b.edge_node_id
+                    AND nb.device_id=''
+            WHERE b.group_id=p_group_id
+              AND b.edge_node_id=p_edge_node_id
+              AND b.device_id<>''
+              AND b.received_at>=nb.received_at
+              AND NOT EXISTS (
+                  SELECT 1 FROM death AS d
+                  WHERE d.group_id=b.group_id
+                    AND d.edge_node_id=b.edge_node_id
+                    AND d.device_id IN (b.device_id, '')
+                    AND d.received_at>=b.received_at
+              );
+        END IF;
 
-    IF msg_type='BIRTH' THEN
+        INSERT INTO session_history
+        (group_id, edge_node_id, device_id, event, received_at)
+        VALUES (p_group_id, p_edge_node_id, p_device_id, 'BIRTH', p_received_at);
 
         UPDATE birth
-        SET timestamp=p_timestamp, received_at=received_ts, metrics=p_metrics
+        SET timestamp=p_timestamp, received_at=p_received_at, metrics=p_metrics
         WHERE group_id=p_group_id
         AND edge_node_id=p_edge_node_id
         AND device_id=p_device_id;
@@ -165,11 +255,11 @@ BEGIN
                             p_device_id,
                             p_timestamp,
                             p_metrics,
-                            received_ts
+                            p_received_at
                         );
         END IF;
 
-        FOREACH metric IN ARRAY p_metrics LOOP
+        FOREACH metric IN ARRAY COALESCE(p_metrics, '{}') LOOP
              -- RAISE WARNING 'Metric: % Alias: %', metric.name, metric.alias;--
             IF metric.alias IS NOT NULL THEN
                 INSERT INTO metrics_info
@@ -180,9 +270,13 @@ BEGIN
                     DO UPDATE SET alias=metric.alias;
             END IF;
         END LOOP;
-    ELSEIF msg_type='DEATH' THEN
+    ELSEIF p_message_type='DEATH' THEN
+        INSERT INTO session_history
+        (group_id, edge_node_id, device_id, event, received_at)
+        VALUES (p_group_id, p_edge_node_id, p_device_id, 'DEATH', p_received_at);
+
         UPDATE death
-        SET timestamp=p_timestamp, received_at=received_ts
+        SET timestamp=p_timestamp, received_at=p_received_at
         WHERE group_id=p_group_id
           AND edge_node_id=p_edge_node_id
           AND device_id=p_device_id;
@@ -197,14 +291,106 @@ BEGIN
                     p_edge_node_id,
                     p_device_id,
                     p_timestamp,
-                    received_ts
+                    p_received_at
                 );
         END IF;
+
+        -- an NDEATH implies the death of all devices of the node that are online
+        IF p_device_id='' THEN
+            INSERT INTO session_history
+            (group_id, edge_node_id, device_id, event, received_at)
+            SELECT b.group_id, b.edge_node_id, b.device_id, 'DEATH', p_received_at
+            FROM birth AS b
+            WHERE b.group_id=p_group_id
+              AND b.edge_node_id=p_edge_node_id
+              AND b.device_id<>''
+              AND NOT EXISTS (
+                  SELECT 1 FROM death AS d
+                  WHERE d.group_id=b.group_id
+                    AND d.edge_node_id=b.edge_node_id
+                    AND d.device_id=b.device_id
+                    AND d.received_at>=b.received_at
+              );
+
+            INSERT INTO death
+            (group_id, edge_node_id, device_id, "timestamp", received_at)
+            SELECT b.group_id, b.edge_node_id, b.device_id, p_timestamp, p_received_at
+            FROM birth AS b
+            WHERE b.group_id=p_group_id
+              AND b.edge_node_id=p_edge_node_id
+              AND b.device_id<>''
+              AND NOT EXISTS (
+                  SELECT 1 FROM death AS d
+                  WHERE d.group_id=b.group_id
+                    AND d.edge_node_id=b.edge_node_id
+                    AND d.device_id=b.device_id
+                    AND d.received_at>=b.received_at
+              )
+            ON CONFLICT(group_id, edge_node_id, device_id)
+                DO UPDATE SET timestamp=EXCLUDED.timestamp, received_at=EXCLUDED.received_at;
+        END IF;
     END IF;
 END
 $$;
 
 
+-- Stores the STATE of a host application. A STATE with an older timestamp than
+-- the stored one is ignored, e.g. a delayed will of a previous session.
+CREATE OR REPLACE PROCEDURE update_host_state(
+    p_host_id TEXT,
+    p_online BOOLEAN,
+    p_timestamp TIMESTAMPTZ,
+    p_received_at TIMESTAMPTZ
+)
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+    INSERT INTO host_state
+        (host_id, online, "timestamp", received_at)
+    VALUES
+        (p_host_id, p_online, p_timestamp, p_received_at)
+    ON CONFLICT(host_id)
+        DO UPDATE SET online=p_online, "timestamp"=p_timestamp, received_at=p_received_at
+        WHERE host_state.timestamp IS NULL OR host_state.timestamp <= p_timestamp;
+END
+$$;
+
+
+CREATE OR REPLACE PROCEDURE insert_sparkplug_payload(
+    p_group_id TEXT,
+    p_message_type TEXT,
+    p_edge_node_id TEXT,
+    p_device_id TEXT,
+    p_timestamp TIMESTAMPTZ,
+    p_seq BIGINT,
+    p_uuid TEXT,
+    p_body bytea,
+    p_metrics metric_type[]
+)
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    msg_type message_type;
+    received_ts TIMESTAMPTZ := now();
+BEGIN
+    msg_type := CASE
+            WHEN p_message_type='DDATA' or p_message_type='NDATA' THEN 'DATA'::message_type
+            WHEN p_message_type='DBIRTH' or p_message_type='NBIRTH' THEN 'BIRTH'::message_type
+            WHEN p_message_type='DDEATH' or p_message_type='NDEATH' THEN 'DEATH'::message_type
+            WHEN p_message_type='DCMD' or p_message_type='NCMD' THEN 'CMD'::message_type
+            WHEN p_message_type='STATE' THEN 'STATE'::message_type
+    END;
+        -- store whole payload plus topic to data table --
+    INSERT INTO data
+        (message_type, received_at, group_id, edge_node_id, device_id, timestamp, seq, uuid, body, metrics)
+    VALUES
+        (msg_type, received_ts, p_group_id, p_edge_node_id, p_device_id, p_timestamp, p_seq, p_uuid, p_body, p_metrics);
+
+    CALL update_sparkplug_state(p_group_id, msg_type, p_edge_node_id, p_device_id, p_timestamp, p_metrics, received_ts);
+END
+$$;
+
+
 CREATE OR REPLACE FUNCTION fetch_metrics(p_group_id TEXT, p_device_name TEXT, p_time_from TIMESTAMPTZ, p_time_to TIMESTAMPTZ, p_limit INT)
     RETURNS TABLE ("time" TIMESTAMPTZ, "metric" TEXT, "value" DOUBLE PRECISION) AS
 $$
@@ -220,12 +406,17 @@ SELECT
             COALESCE(
                     m.value_double,
                     CAST(m.value_int AS DOUBLE PRECISION),
+                    CAST(m.value_long AS DOUBLE PRECISION),
                     CAST(m.value_uint64 AS DOUBLE PRECISION),
                     CAST(m.value_float AS DOUBLE PRECISION)
         ) AS value
 FROM data as d
     CROSS JOIN LATERAL unnest(d.metrics) AS m
-    LEFT JOIN metrics_info a ON m.alias = a.alias
+    LEFT JOIN metrics_info a
+        ON a.alias = m.alias
+        AND a.group_id = d.group_id
+        AND a.edge_node_id = d.edge_node_id
+        AND a.device_id = d.device_id
 WHERE d.group_id= p_group_id
   AND d.message_type in ('BIRTH', 'DATA')
   AND m.datatype NOT in(12, 13, 14) -- ignore text and date metrics --
@@ -302,16 +493,22 @@ BEGIN
     json := '{}'::jsonb;
     IF properties IS NOT NULL THEN
 
-        -- iterate over the keys and values in the propertyset_type, and add each key-value pair to the JSON object
-        FOR key_index IN 1..array_length(properties.keys, 1) LOOP
+        -- iterate over the keys and values in the propertyset_type, and add each key-value pair to the JSON object;
+        -- nested property sets become nested objects, property set lists arrays of objects
+        FOR key_index IN 1..COALESCE(array_length(properties.keys, 1), 0) LOOP
                 json := json || jsonb_build_object(
                         properties.keys[key_index],
                         COALESCE(to_jsonb(properties.values[key_index].string_value),
                                  to_jsonb(properties.values[key_index].int_value),
                                  to_jsonb(properties.values[key_index].long_value),
+                                 to_jsonb(properties.values[key_index].uint64_value),
                                  to_jsonb(properties.values[key_index].float_value),
                                  to_jsonb(properties.values[key_index].double_value),
-                                 to_jsonb(properties.values[key_index].boolean_value)
+                                 to_jsonb(properties.values[key_index].boolean_value),
+                                 propertyset_jsonb_to_json(properties.values[key_index].propertyset_value),
+                                 (SELECT jsonb_agg(propertyset_jsonb_to_json(s.value) ORDER BY s.ordinality)
+                                  FROM jsonb_array_elements(properties.values[key_index].propertysets_value)
+                                      WITH ORDINALITY AS s)
                         )
                                 );
             END LOOP;
@@ -323,6 +520,17 @@ END;
 $$ LANGUAGE plpgsql;
 
 
+-- propertyset_jsonb_to_json is propertyset_to_json for a nested property set,
+-- stored as the JSON of a propertyset_type. NULL if there is none.
+CREATE OR REPLACE FUNCTION propertyset_jsonb_to_json(properties jsonb)
+    RETURNS jsonb
+AS $$
+    SELECT p.json
+    FROM propertyset_to_json(jsonb_populate_record(NULL::propertyset_type, properties)) AS p
+    WHERE jsonb_typeof(properties) = 'object';
+$$ LANGUAGE sql;
+
+
 CREATE OR REPLACE FUNCTION fetch_grafana_config(p_group_id TEXT, p_device_name TEXT)
     RETURNS TABLE ("name" TEXT, "color" TEXT, "unit" TEXT, js jsonb) AS
 $$